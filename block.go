@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+)
+
+// the block response modes of the reject upstreams
+const (
+	// BlockModeNoData answers NOERROR without any records and a synthetic SOA
+	BlockModeNoData = "nodata"
+	// BlockModeNXDomain answers NXDOMAIN with a synthetic SOA
+	BlockModeNXDomain = "nxdomain"
+	// BlockModeRefused answers REFUSED
+	BlockModeRefused = "refused"
+	// BlockModeNull answers 0.0.0.0 or :: to the A and AAAA requests
+	BlockModeNull = "null"
+	// BlockModeSinkhole answers the sinkhole addresses to the A and AAAA requests
+	BlockModeSinkhole = "sinkhole"
+)
+
+// blockEDECodes maps the ede config to the extended DNS error codes, 0 means no ede
+var blockEDECodes = map[string]uint16{
+	"none":     0,
+	"blocked":  dns.ExtendedErrorCodeBlocked,
+	"filtered": dns.ExtendedErrorCodeFiltered,
+}
+
+// defaultBlockResponse is how the built-in reject upstream answers
+var defaultBlockResponse = &BlockResponse{Mode: BlockModeNoData, TTL: defaultStaticTTL, EDE: dns.ExtendedErrorCodeBlocked}
+
+// BlockResponse describes how the blocked requests are answered
+type BlockResponse struct {
+	Mode     string
+	TTL      uint32
+	Sinkhole []net.IP
+	EDE      uint16
+}
+
+// NewBlockResponse creates a block response, the addresses are only used in the sinkhole mode
+func NewBlockResponse(mode string, ttl uint32, addresses []string, ede string) (*BlockResponse, error) {
+	block := &BlockResponse{Mode: mode, TTL: ttl}
+
+	switch mode {
+	case BlockModeNoData, BlockModeNXDomain, BlockModeRefused, BlockModeNull:
+		if len(addresses) > 0 {
+			return nil, fmt.Errorf("addresses are only allowed in the %s mode", BlockModeSinkhole)
+		}
+	case BlockModeSinkhole:
+		if len(addresses) == 0 {
+			return nil, fmt.Errorf("%s mode requires addresses", BlockModeSinkhole)
+		}
+		for _, address := range addresses {
+			ip := net.ParseIP(strings.TrimSpace(address))
+			if ip == nil {
+				return nil, fmt.Errorf("invalid sinkhole address %q", address)
+			}
+			block.Sinkhole = append(block.Sinkhole, ip)
+		}
+	default:
+		return nil, fmt.Errorf("unknown block mode %q", mode)
+	}
+
+	code, ok := blockEDECodes[ede]
+	if !ok {
+		return nil, fmt.Errorf("unknown ede %q", ede)
+	}
+	block.EDE = code
+
+	return block, nil
+}
+
+// Reply builds the reply of the blocked request
+func (block *BlockResponse) Reply(req *dns.Msg) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+
+	question := req.Question[0]
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: block.TTL}
+
+	switch block.Mode {
+	case BlockModeNXDomain:
+		msg.Rcode = dns.RcodeNameError
+		msg.Ns = append(msg.Ns, syntheticSOA(question.Name, block.TTL))
+	case BlockModeRefused:
+		msg.Rcode = dns.RcodeRefused
+	case BlockModeNull, BlockModeSinkhole:
+		ips := block.Sinkhole
+		if block.Mode == BlockModeNull {
+			ips = []net.IP{net.IPv4zero, net.IPv6zero}
+		}
+		for _, ip := range ips {
+			switch {
+			case question.Qtype == dns.TypeA && ip.To4() != nil:
+				msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: ip.To4()})
+			case question.Qtype == dns.TypeAAAA && ip.To4() == nil:
+				msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		if len(msg.Answer) == 0 {
+			msg.Ns = append(msg.Ns, syntheticSOA(question.Name, block.TTL))
+		}
+	default:
+		msg.Ns = append(msg.Ns, syntheticSOA(question.Name, block.TTL))
+	}
+
+	// the extended DNS error is only sent to the EDNS clients
+	if block.EDE != 0 && req.IsEdns0() != nil {
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		opt.Option = append(opt.Option, &dns.EDNS0_EDE{InfoCode: block.EDE})
+		msg.Extra = append(msg.Extra, opt)
+	}
+
+	return msg
+}
+
+// syntheticSOA makes a SOA record for the negative answers which are not from any real zone
+func syntheticSOA(name string, ttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: name, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: ttl},
+		Ns:      "fake-for-negative-caching.dohproxy.",
+		Mbox:    "hostmaster.dohproxy.",
+		Serial:  1,
+		Refresh: 1800,
+		Retry:   900,
+		Expire:  604800,
+		Minttl:  ttl,
+	}
+}
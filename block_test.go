@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBlockResponse_Reply(t *testing.T) {
+	ta := assert.New(t)
+
+	reply := func(mode string, addresses []string, qtype uint16) *dns.Msg {
+		block, err := NewBlockResponse(mode, 300, addresses, "blocked")
+		ta.Nil(err)
+		req := &dns.Msg{}
+		req.SetQuestion("ads.adxxx.com.", qtype)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+		return block.Reply(req)
+	}
+
+	msg := reply(BlockModeNXDomain, nil, dns.TypeA)
+	ta.Equal(dns.RcodeNameError, msg.Rcode)
+	ta.Equal(uint32(300), msg.Ns[0].(*dns.SOA).Minttl)
+	ta.Equal(uint16(dns.ExtendedErrorCodeBlocked), msg.IsEdns0().Option[0].(*dns.EDNS0_EDE).InfoCode)
+
+	msg = reply(BlockModeNoData, nil, dns.TypeA)
+	ta.Equal(dns.RcodeSuccess, msg.Rcode)
+	ta.Len(msg.Answer, 0)
+	ta.Len(msg.Ns, 1)
+
+	ta.Equal(dns.RcodeRefused, reply(BlockModeRefused, nil, dns.TypeA).Rcode)
+
+	msg = reply(BlockModeNull, nil, dns.TypeAAAA)
+	ta.Equal("::", msg.Answer[0].(*dns.AAAA).AAAA.String())
+	ta.Equal(uint32(300), msg.Answer[0].Header().Ttl)
+
+	msg = reply(BlockModeSinkhole, []string{"10.0.0.80", "fd00::80"}, dns.TypeA)
+	ta.Len(msg.Answer, 1)
+	ta.Equal("10.0.0.80", msg.Answer[0].(*dns.A).A.String())
+
+	// NODATA for the other types
+	msg = reply(BlockModeSinkhole, []string{"10.0.0.80"}, dns.TypeMX)
+	ta.Len(msg.Answer, 0)
+	ta.Len(msg.Ns, 1)
+
+	_, err := NewBlockResponse(BlockModeSinkhole, 300, nil, "blocked")
+	ta.NotNil(err)
+	_, err = NewBlockResponse(BlockModeNull, 300, []string{"10.0.0.80"}, "blocked")
+	ta.NotNil(err)
+	_, err = NewBlockResponse(BlockModeNull, 300, nil, "censored")
+	ta.NotNil(err)
+}
+
+func TestHandler_BlockCache(t *testing.T) {
+	ta := assert.New(t)
+
+	block, err := NewBlockResponse(BlockModeNull, 300, nil, "blocked")
+	ta.Nil(err)
+	handler := NewHandler("default")
+	handler.Upstreams["reject"] = &UpstreamReject{UpstreamImpl: UpstreamImpl{name: "reject"}, block: block}
+	handler.AddRule("suffix:adxxx.com reject")
+
+	req := &dns.Msg{}
+	req.SetQuestion("ads.adxxx.com.", dns.TypeA)
+	req.SetEdns0(dns.DefaultMsgSize, false)
+	msg := testExchange(handler, req)
+	ta.NotNil(msg.IsEdns0())
+
+	// the answer with the EDE isn't cached for the non-EDNS clients
+	key := cacheKey(req, handler.route(NewQuery(nil, req, "")))
+	_, found := handler.cache.Get(key, &dns.Msg{})
+	ta.False(found)
+
+	// the OPT record of a cached answer is only sent to the EDNS clients
+	handler.cache.Set(key, msg)
+	cached, found := handler.cache.Get(key, &dns.Msg{})
+	ta.True(found)
+	ta.Nil(cached.IsEdns0())
+	cached, _ = handler.cache.Get(key, req)
+	ta.NotNil(cached.IsEdns0())
+}
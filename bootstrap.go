@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bootstrapTimeout is the timeout of a query to a bootstrap server
+const bootstrapTimeout = 2 * time.Second
+
+// the resolved addresses are cached by their TTL, but not shorter than bootstrapMinTTL or longer than bootstrapMaxTTL
+const (
+	bootstrapMinTTL = time.Minute
+	bootstrapMaxTTL = time.Hour
+)
+
+// Bootstrap resolves the host names of the encrypted upstreams without the system resolver, which could be dohproxy
+// itself, a nil Bootstrap uses the system resolver
+//
+// The pinned addresses are only answered to the upstream host, the other host names, e.g. the ones in the redirects,
+// are resolved by the bootstrap servers in order, or by the system resolver if there are no servers. The resolved
+// addresses are cached by their TTL, and still used if they can't be refreshed.
+type Bootstrap struct {
+	host    string
+	ips     []net.IP
+	servers []string
+	client  *dns.Client
+
+	mu    sync.Mutex
+	cache map[string]*bootstrapEntry
+}
+
+// bootstrapEntry is the cached addresses of a host name
+type bootstrapEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+// NewBootstrap creates a bootstrap resolving the host names by the DNS servers, or answering the pinned addresses
+// to the host, the default port of the servers is 53
+func NewBootstrap(servers []string, host string, ips []net.IP) *Bootstrap {
+	b := &Bootstrap{
+		host:   strings.ToLower(strings.TrimSuffix(host, ".")),
+		ips:    ips,
+		client: &dns.Client{Timeout: bootstrapTimeout},
+		cache:  map[string]*bootstrapEntry{},
+	}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(strings.Trim(server, "[]"), "53")
+		}
+		b.servers = append(b.servers, server)
+	}
+	return b
+}
+
+// Resolve returns the addresses of the host
+func (b *Bootstrap) Resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if b != nil && len(b.ips) > 0 && strings.EqualFold(strings.TrimSuffix(host, "."), b.host) {
+		return b.ips, nil
+	}
+	if b == nil || len(b.servers) == 0 {
+		return net.DefaultResolver.LookupIP(ctx, "ip", host)
+	}
+
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+	b.mu.Lock()
+	entry := b.cache[key]
+	b.mu.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		return entry.ips, nil
+	}
+
+	ips, ttl, err := b.lookup(ctx, host)
+	if err != nil {
+		if entry != nil {
+			zap.L().Named("answer").Warn("refresh bootstrap address failed, using the expired one", zap.String("host", host), zap.Error(err))
+			return entry.ips, nil
+		}
+		return nil, err
+	}
+
+	b.mu.Lock()
+	b.cache[key] = &bootstrapEntry{ips: ips, expires: time.Now().Add(ttl)}
+	b.mu.Unlock()
+	return ips, nil
+}
+
+// lookup queries the A and AAAA records of the host from the bootstrap servers in order, and returns the addresses
+// and the cache duration
+func (b *Bootstrap) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	err := errors.New("no bootstrap address of " + host)
+	for _, server := range b.servers {
+		var ips []net.IP
+		ttl := bootstrapMaxTTL
+		failed := 0
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			req := &dns.Msg{}
+			req.SetQuestion(dns.Fqdn(host), qtype)
+			resp, _, qerr := b.client.ExchangeContext(ctx, req, server)
+			if qerr == nil && resp.Truncated {
+				tcp := &dns.Client{Net: "tcp", Timeout: bootstrapTimeout}
+				resp, _, qerr = tcp.ExchangeContext(ctx, req, server)
+			}
+			if qerr != nil {
+				// the addresses of the other type are still usable
+				err = qerr
+				failed++
+				continue
+			}
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					ips = append(ips, rr.A)
+				case *dns.AAAA:
+					ips = append(ips, rr.AAAA)
+				default:
+					continue
+				}
+				if recordTTL := time.Duration(rr.Header().Ttl) * time.Second; recordTTL < ttl {
+					ttl = recordTTL
+				}
+			}
+		}
+		if len(ips) > 0 {
+			if ttl < bootstrapMinTTL {
+				ttl = bootstrapMinTTL
+			}
+			return ips, ttl, nil
+		}
+		if failed == 0 {
+			err = errors.New("no bootstrap address of " + host)
+		}
+	}
+	return nil, 0, err
+}
+
+// DialContext connects to the address with the host resolved by the bootstrap, the addresses are tried in order
+func (b *Bootstrap) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := b.Resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveAddress replaces the host in the address with its first address
+func (b *Bootstrap) resolveAddress(ctx context.Context, address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	ips, err := b.Resolve(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
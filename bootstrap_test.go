@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBootstrap_Resolve(t *testing.T) {
+	ta := assert.New(t)
+
+	var queries int32
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ta.Nil(err)
+	server := &dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			atomic.AddInt32(&queries, 1)
+			msg := &dns.Msg{}
+			msg.SetReply(req)
+			if req.Question[0].Name == "v4only.test." {
+				if req.Question[0].Qtype == dns.TypeA {
+					rr, _ := dns.NewRR("v4only.test. 300 IN A 10.0.0.4")
+					msg.Answer = append(msg.Answer, rr)
+				} else {
+					// the TCP retry fails as there's no TCP listener
+					msg.Truncated = true
+				}
+			}
+			if req.Question[0].Name == "dns.test." {
+				switch req.Question[0].Qtype {
+				case dns.TypeA:
+					rr, _ := dns.NewRR("dns.test. 300 IN A 10.0.0.6")
+					msg.Answer = append(msg.Answer, rr)
+				case dns.TypeAAAA:
+					rr, _ := dns.NewRR("dns.test. 600 IN AAAA fd00::6")
+					msg.Answer = append(msg.Answer, rr)
+				}
+			}
+			w.WriteMsg(msg)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	ctx := context.Background()
+	// the unreachable server is skipped
+	bootstrap := NewBootstrap([]string{"127.0.0.1:1", conn.LocalAddr().String()}, "", nil)
+	ips, err := bootstrap.Resolve(ctx, "dns.test")
+	ta.Nil(err)
+	if ta.Len(ips, 2) {
+		ta.Equal("10.0.0.6", ips[0].String())
+		ta.Equal("fd00::6", ips[1].String())
+	}
+	ta.Equal(int32(2), atomic.LoadInt32(&queries))
+
+	// the addresses are cached by the shortest TTL, regardless of the case of the host
+	_, err = bootstrap.Resolve(ctx, "DNS.test.")
+	ta.Nil(err)
+	ta.Equal(int32(2), atomic.LoadInt32(&queries))
+	ta.WithinDuration(time.Now().Add(300*time.Second), bootstrap.cache["dns.test"].expires, 5*time.Second)
+
+	// the expired addresses are refreshed, and still used if the refresh fails
+	bootstrap.cache["dns.test"].expires = time.Now()
+	_, err = bootstrap.Resolve(ctx, "dns.test")
+	ta.Nil(err)
+	ta.Equal(int32(4), atomic.LoadInt32(&queries))
+	bootstrap.cache["dns.test"].expires = time.Now()
+	bootstrap.servers = []string{"127.0.0.1:1"}
+	ips, err = bootstrap.Resolve(ctx, "dns.test")
+	ta.Nil(err)
+	ta.Len(ips, 2)
+
+	_, err = NewBootstrap([]string{conn.LocalAddr().String()}, "", nil).Resolve(ctx, "unknown.test")
+	ta.NotNil(err)
+
+	// the A addresses are kept when the AAAA query fails
+	ips, err = NewBootstrap([]string{conn.LocalAddr().String()}, "", nil).Resolve(ctx, "v4only.test")
+	ta.Nil(err)
+	if ta.Len(ips, 1) {
+		ta.Equal("10.0.0.4", ips[0].String())
+	}
+
+	// the pinned addresses are only answered to the upstream host, and the IP literals are not resolved
+	bootstrap = NewBootstrap([]string{conn.LocalAddr().String()}, "relay.test", []net.IP{net.IPv4(10, 0, 0, 7)})
+	ips, err = bootstrap.Resolve(ctx, "Relay.test.")
+	ta.Nil(err)
+	ta.Equal("10.0.0.7", ips[0].String())
+	ips, err = bootstrap.Resolve(ctx, "dns.test")
+	ta.Nil(err)
+	ta.Equal("10.0.0.6", ips[0].String())
+	ips, err = bootstrap.Resolve(ctx, "9.9.9.9")
+	ta.Nil(err)
+	ta.Equal("9.9.9.9", ips[0].String())
+
+	ta.Equal([]string{"9.9.9.9:53", "[2620:fe::fe]:53", "1.1.1.1:5353"}, NewBootstrap([]string{"9.9.9.9", "2620:fe::fe", "1.1.1.1:5353"}, "", nil).servers)
+}
+
+func TestUpstreamHost(t *testing.T) {
+	ta := assert.New(t)
+	for _, config := range []*UpstreamConfig{
+		{Type: "doh", Address: "https://dns.test/dns-query"},
+		{Type: "doh-json", Address: "https://dns.test:8443/resolve"},
+		{Type: "dot", Address: "tls://dns.test:853"},
+		{Type: "doq", Address: "dns.test"},
+		{Type: "odoh", Address: "https://target.test/dns-query", Relay: "https://dns.test/proxy"},
+	} {
+		ta.Equal("dns.test", upstreamHost(config), config.Type)
+	}
+}
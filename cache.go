@@ -6,7 +6,17 @@ import (
 	"time"
 )
 
-var dnsCache = cache.New(cache.DefaultExpiration, 10*time.Minute)
+// Cache is an in-memory DNS message cache, each view owns one
+type Cache struct {
+	store *cache.Cache
+}
+
+// NewCache creates an empty DNS message cache
+func NewCache() *Cache {
+	return &Cache{
+		store: cache.New(cache.DefaultExpiration, 10*time.Minute),
+	}
+}
 
 func getMinTTL(answer []dns.RR) uint32 {
 	var minTTL uint32
@@ -23,19 +33,21 @@ func getMinTTL(answer []dns.RR) uint32 {
 	return minTTL
 }
 
-// SetCache set a dns question/msg cache to the dohproxy in-memory cache
-func SetCache(question string, msg *dns.Msg) {
+// Set set a dns question/msg cache to the in-memory cache
+func (c *Cache) Set(question string, msg *dns.Msg) {
 	if len(msg.Answer) == 0 {
 		return
 	}
 
-	dnsCache.Set(question, msg, time.Duration(getMinTTL(msg.Answer))*time.Second)
+	c.store.Set(question, msg.Copy(), time.Duration(getMinTTL(msg.Answer))*time.Second)
 }
 
-// GetCache get a dns cache by question string
-func GetCache(question string, id uint16) (*dns.Msg, bool) {
-	if msg, expiration, found := dnsCache.GetWithExpiration(question); found {
-		newMsg := msg.(*dns.Msg)
+// Get get a dns cache by question string as the reply of the request, the OPT record is left out for the non-EDNS
+// requests
+func (c *Cache) Get(question string, req *dns.Msg) (*dns.Msg, bool) {
+	if msg, expiration, found := c.store.GetWithExpiration(question); found {
+		// the cached message is shared, always work on a copy
+		newMsg := msg.(*dns.Msg).Copy()
 
 		// set new ttl
 		minTTL := getMinTTL(newMsg.Answer)
@@ -45,7 +57,17 @@ func GetCache(question string, id uint16) (*dns.Msg, bool) {
 		}
 
 		// set new id
-		newMsg.Id = id
+		newMsg.Id = req.Id
+
+		if req.IsEdns0() == nil {
+			extra := newMsg.Extra[:0]
+			for _, rr := range newMsg.Extra {
+				if rr.Header().Rrtype != dns.TypeOPT {
+					extra = append(extra, rr)
+				}
+			}
+			newMsg.Extra = extra
+		}
 
 		return newMsg, true
 	}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// CheckConfig loads the config files and writes the rules of every view, and whether they are active at the time,
+// the log config is ignored so the logs stay out of the report
+func CheckConfig(configPaths []string, w io.Writer, now time.Time) {
+	_, handlers := loadConfig(configPaths, false)
+
+	var names []string
+	for name := range handlers {
+		if name != "default" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{"default"}, names...)
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "view %s\n", name)
+		for _, rule := range handlers[name].Rules {
+			status := "active"
+			if !ruleActive(rule, now) {
+				status = "inactive"
+			}
+			schedule := "-"
+			if rule.Schedule() != nil {
+				schedule = rule.Schedule().Name()
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", status, schedule, rule.Text())
+		}
+	}
+	tw.Flush()
+}
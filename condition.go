@@ -0,0 +1,351 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+// Query describes a request being routed, the conditions are tested against it
+type Query struct {
+	dns.Question
+	Client   net.IP
+	Listener string
+	Time     time.Time
+}
+
+// NewQuery creates the query of the request received from the listener
+func NewQuery(w dns.ResponseWriter, req *dns.Msg, listener string) *Query {
+	q := &Query{
+		Question: req.Question[0],
+		Listener: listener,
+		Time:     time.Now(),
+	}
+	if w != nil {
+		switch addr := w.RemoteAddr().(type) {
+		case *net.UDPAddr:
+			q.Client = addr.IP
+		case *net.TCPAddr:
+			q.Client = addr.IP
+		}
+	}
+	return q
+}
+
+// WithQuestion returns a copy of the query with another question, the client, listener and time are kept
+func (q *Query) WithQuestion(question dns.Question) *Query {
+	newQuery := *q
+	newQuery.Question = question
+	return &newQuery
+}
+
+// Condition is a part of the composite rules
+type Condition interface {
+	Test(q *Query) bool
+	// Specificity tells how specific the condition is, see Rule.Specificity
+	Specificity() int
+}
+
+// nameCondition matches the query name by a name rule
+type nameCondition struct {
+	rule Rule
+}
+
+// Test returns if the query name matches the rule
+func (c *nameCondition) Test(q *Query) bool {
+	return c.rule.Matches(q.Name)
+}
+
+// Specificity returns the specificity of the rule
+func (c *nameCondition) Specificity() int {
+	return c.rule.Specificity()
+}
+
+// qtypeCondition matches the query types
+type qtypeCondition struct {
+	qtypes []uint16
+}
+
+// Test returns if the query type is one of the types
+func (c *qtypeCondition) Test(q *Query) bool {
+	for _, qtype := range c.qtypes {
+		if q.Qtype == qtype {
+			return true
+		}
+	}
+	return false
+}
+
+// Specificity returns 1
+func (c *qtypeCondition) Specificity() int {
+	return 1
+}
+
+// clientCondition matches the client addresses
+type clientCondition struct {
+	ipSet *IPSet
+}
+
+// Test returns if the client address is in the ip set
+func (c *clientCondition) Test(q *Query) bool {
+	return q.Client != nil && c.ipSet.Contains(q.Client)
+}
+
+// Specificity returns 1
+func (c *clientCondition) Specificity() int {
+	return 1
+}
+
+// listenerCondition matches the listener names
+type listenerCondition struct {
+	listeners []string
+}
+
+// Test returns if the request is received from one of the listeners
+func (c *listenerCondition) Test(q *Query) bool {
+	for _, listener := range c.listeners {
+		if q.Listener == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// Specificity returns 1
+func (c *listenerCondition) Specificity() int {
+	return 1
+}
+
+// timeCondition matches the time of the day, the window could cross the midnight, e.g. 22:00-06:00
+type timeCondition struct {
+	// start and end are the minutes since the midnight
+	start, end int
+	// location is the time zone of the window, nil means the local time zone
+	location *time.Location
+}
+
+func parseTimeWindow(s string) (*timeCondition, error) {
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("time window must be like 22:00-06:00, got %q", s)
+	}
+	var minutes [2]int
+	for i, bound := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(bound))
+		if err != nil {
+			return nil, fmt.Errorf("invalid time %q", bound)
+		}
+		minutes[i] = t.Hour()*60 + t.Minute()
+	}
+	return &timeCondition{start: minutes[0], end: minutes[1]}, nil
+}
+
+// Test returns if the query time is in the window
+func (c *timeCondition) Test(q *Query) bool {
+	t := q.Time
+	if c.location != nil {
+		t = t.In(c.location)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	if c.start <= c.end {
+		return minute >= c.start && minute < c.end
+	}
+	return minute >= c.start || minute < c.end
+}
+
+// Specificity returns 1
+func (c *timeCondition) Specificity() int {
+	return 1
+}
+
+// allCondition matches if all the conditions match
+type allCondition struct {
+	conditions []Condition
+}
+
+// Test returns if all the conditions match
+func (c *allCondition) Test(q *Query) bool {
+	for _, condition := range c.conditions {
+		if !condition.Test(q) {
+			return false
+		}
+	}
+	return true
+}
+
+// Specificity returns the sum of the condition specificities, every condition narrows the match
+func (c *allCondition) Specificity() int {
+	specificity := 0
+	for _, condition := range c.conditions {
+		specificity += condition.Specificity()
+	}
+	return specificity
+}
+
+// anyCondition matches if any of the conditions matches
+type anyCondition struct {
+	conditions []Condition
+}
+
+// Test returns if any of the conditions matches
+func (c *anyCondition) Test(q *Query) bool {
+	for _, condition := range c.conditions {
+		if condition.Test(q) {
+			return true
+		}
+	}
+	return false
+}
+
+// Specificity returns the lowest condition specificity
+func (c *anyCondition) Specificity() int {
+	specificity := 0
+	for i, condition := range c.conditions {
+		if i == 0 || condition.Specificity() < specificity {
+			specificity = condition.Specificity()
+		}
+	}
+	return specificity
+}
+
+// notCondition matches if the condition doesn't match
+type notCondition struct {
+	condition Condition
+}
+
+// Test returns if the condition doesn't match
+func (c *notCondition) Test(q *Query) bool {
+	return !c.condition.Test(q)
+}
+
+// Specificity returns the condition specificity
+func (c *notCondition) Specificity() int {
+	return c.condition.Specificity()
+}
+
+// ParseConditionNode converts a decoded YAML node into a Condition, the node is a name condition like
+// suffix:google.com, or a mapping with one of the keys: all, any, not, name, qtype, client, listener, time
+func ParseConditionNode(node interface{}, ipSets map[string]*IPSet) (Condition, error) {
+	switch node := node.(type) {
+	case string:
+		rule, err := ParseCondition(node)
+		if err != nil {
+			return nil, err
+		}
+		return &nameCondition{rule: rule}, nil
+	case map[interface{}]interface{}:
+		if len(node) != 1 {
+			return nil, fmt.Errorf("condition must have exactly 1 key, got %d", len(node))
+		}
+		for key, value := range node {
+			return parseConditionKey(fmt.Sprint(key), value, ipSets)
+		}
+	}
+	return nil, fmt.Errorf("invalid condition %v", node)
+}
+
+func parseConditionKey(key string, value interface{}, ipSets map[string]*IPSet) (Condition, error) {
+	switch key {
+	case "all", "any":
+		nodes, ok := value.([]interface{})
+		if !ok || len(nodes) == 0 {
+			return nil, fmt.Errorf("%s requires a condition list", key)
+		}
+		var conditions []Condition
+		for _, node := range nodes {
+			condition, err := ParseConditionNode(node, ipSets)
+			if err != nil {
+				return nil, err
+			}
+			conditions = append(conditions, condition)
+		}
+		if key == "all" {
+			return &allCondition{conditions: conditions}, nil
+		}
+		return &anyCondition{conditions: conditions}, nil
+	case "not":
+		condition, err := ParseConditionNode(value, ipSets)
+		if err != nil {
+			return nil, err
+		}
+		return &notCondition{condition: condition}, nil
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("%s requires a string", key)
+	}
+	switch key {
+	case "name":
+		return ParseConditionNode(s, ipSets)
+	case "qtype":
+		condition := &qtypeCondition{}
+		for _, name := range strings.Split(s, ",") {
+			qtype, ok := dns.StringToType[strings.ToUpper(strings.TrimSpace(name))]
+			if !ok {
+				return nil, fmt.Errorf("unknown qtype %q", name)
+			}
+			condition.qtypes = append(condition.qtypes, qtype)
+		}
+		return condition, nil
+	case "client":
+		if ipSet, ok := ipSets[s]; ok {
+			return &clientCondition{ipSet: ipSet}, nil
+		}
+		ipSet, err := ParseIPSet(strings.Split(s, ","))
+		if err != nil {
+			return nil, err
+		}
+		return &clientCondition{ipSet: ipSet}, nil
+	case "listener":
+		condition := &listenerCondition{}
+		for _, listener := range strings.Split(s, ",") {
+			condition.listeners = append(condition.listeners, strings.TrimSpace(listener))
+		}
+		return condition, nil
+	case "time":
+		// the window could be followed by a time zone, e.g. 21:00-07:00 Europe/Berlin
+		fields := strings.Fields(s)
+		if len(fields) == 0 || len(fields) > 2 {
+			return nil, fmt.Errorf("time condition must be like 22:00-06:00 [time_zone], got %q", s)
+		}
+		condition, err := parseTimeWindow(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(fields) == 2 {
+			if condition.location, err = time.LoadLocation(fields[1]); err != nil {
+				return nil, fmt.Errorf("unknown time zone %q", fields[1])
+			}
+		}
+		return condition, nil
+	}
+	return nil, errors.New("unknown condition " + key)
+}
+
+// formatConditionNode returns the condition node in one line, e.g. all(suffix:corp.com, not(client:vpn-clients))
+func formatConditionNode(node interface{}) string {
+	switch node := node.(type) {
+	case []interface{}:
+		var items []string
+		for _, item := range node {
+			items = append(items, formatConditionNode(item))
+		}
+		return strings.Join(items, ", ")
+	case map[interface{}]interface{}:
+		var items []string
+		for key, value := range node {
+			switch key {
+			case "all", "any", "not":
+				items = append(items, fmt.Sprintf("%v(%s)", key, formatConditionNode(value)))
+			default:
+				items = append(items, fmt.Sprintf("%v:%s", key, formatConditionNode(value)))
+			}
+		}
+		return strings.Join(items, ", ")
+	}
+	return fmt.Sprint(node)
+}
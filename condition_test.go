@@ -0,0 +1,97 @@
+package main
+
+import (
+	"github.com/go-yaml/yaml"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandler_AddRuleConfig(t *testing.T) {
+	ta := assert.New(t)
+
+	var rules []*RuleConfig
+	ta.Nil(yaml.Unmarshal([]byte(`
+- match:
+    all:
+      - suffix:corp.com
+      - not:
+          client: vpn-clients
+  upstream: reject
+- match:
+    all:
+      - listener: kids-udp
+      - qtype: A,AAAA
+      - time: "21:00-07:00"
+  upstream: "0.0.0.0,::"
+- match:
+    any:
+      - fqdn:a.com
+      - fqdn:b.com
+  upstream: 10.0.0.1
+  options: [ttl=300]
+- suffix:corp.com corp
+- wildcard:* public
+`), &rules))
+	ta.Len(rules, 5)
+	ta.Equal("suffix:corp.com corp", rules[3].Text)
+
+	ipSets := map[string]*IPSet{}
+	ipSets["vpn-clients"], _ = ParseIPSet([]string{"10.9.0.0/16"})
+
+	handler := NewHandler("default")
+	handler.Upstreams["public"] = &testUpstream{name: "public"}
+	handler.Upstreams["corp"] = &testUpstream{name: "corp"}
+	for _, rule := range rules {
+		handler.AddRuleConfig(rule, ipSets, nil)
+	}
+
+	route := func(name string, qtype uint16, client, listener string, hour int) string {
+		rule := handler.route(&Query{
+			Question: dns.Question{Name: name, Qtype: qtype},
+			Client:   net.ParseIP(client),
+			Listener: listener,
+			Time:     time.Date(2020, 1, 1, hour, 0, 0, 0, time.Local),
+		})
+		if rule.Upstream() == nil {
+			return "static"
+		}
+		return rule.Upstream().Name()
+	}
+
+	ta.Equal("reject", route("git.corp.com.", dns.TypeA, "192.168.1.10", "lan", 12))
+	ta.Equal("corp", route("git.corp.com.", dns.TypeA, "10.9.0.10", "vpn", 12))
+
+	ta.Equal("static", route("youtube.com.", dns.TypeA, "192.168.1.20", "kids-udp", 22))
+	ta.Equal("static", route("youtube.com.", dns.TypeAAAA, "192.168.1.20", "kids-udp", 6))
+	ta.Equal("public", route("youtube.com.", dns.TypeA, "192.168.1.20", "kids-udp", 12))
+	ta.Equal("public", route("youtube.com.", dns.TypeMX, "192.168.1.20", "kids-udp", 22))
+	ta.Equal("public", route("youtube.com.", dns.TypeA, "192.168.1.20", "lan", 22))
+
+	ta.Equal("static", route("b.com.", dns.TypeA, "192.168.1.20", "lan", 12))
+}
+
+func TestParseConditionNode(t *testing.T) {
+	ta := assert.New(t)
+
+	for _, node := range []interface{}{
+		map[interface{}]interface{}{"qtype": "NOPE"},
+		map[interface{}]interface{}{"client": "10.0.0.0/33"},
+		map[interface{}]interface{}{"time": "21:00"},
+		map[interface{}]interface{}{"time": "21:00-07:00 Mars/Olympus"},
+		map[interface{}]interface{}{"all": []interface{}{}},
+		map[interface{}]interface{}{"unknown": "x"},
+		map[interface{}]interface{}{"qtype": "A", "client": "10.0.0.0/8"},
+		"suffix",
+	} {
+		_, err := ParseConditionNode(node, nil)
+		ta.NotNil(err, "%v", node)
+	}
+	// the time zone of the window is used
+	condition, err := ParseConditionNode(map[interface{}]interface{}{"time": "21:00-07:00 Asia/Tokyo"}, nil)
+	ta.Nil(err)
+	ta.True(condition.Test(&Query{Time: time.Date(2020, 1, 1, 13, 0, 0, 0, time.UTC)}))
+	ta.False(condition.Test(&Query{Time: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}))
+}
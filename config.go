@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-yaml/yaml"
+	"go.uber.org/zap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configExtensions are the extensions of the config files read from a directory
+var configExtensions = map[string]bool{
+	".yml":  true,
+	".yaml": true,
+}
+
+// configLoader reads the config files and merges them in order
+type configLoader struct {
+	config *Config
+	// loading is the files being read, to find the include cycles
+	loading map[string]bool
+	// loaded is the files already merged, every file is merged only once
+	loaded map[string]bool
+	// origins tells which file defines the named entries, for the conflict errors
+	origins map[string]string
+}
+
+// ReadConfig reads and merges the config files in order, a path could be a file, a directory or a glob pattern
+//
+// The files in a directory are read by the name order, and the files included by a file are read right after it.
+// The listen entries, rules and response rules are appended in the order they are read, and the upstreams, ip sets,
+// schedules, view upstreams and the top level settings can only be defined once.
+func ReadConfig(paths []string) (*Config, error) {
+	loader := &configLoader{
+		config:  &Config{},
+		loading: map[string]bool{},
+		loaded:  map[string]bool{},
+		origins: map[string]string{},
+	}
+	for _, path := range paths {
+		if err := loader.loadPath(path); err != nil {
+			return nil, err
+		}
+	}
+	return loader.config, nil
+}
+
+// expandConfigPath returns the config files of the path
+func expandConfigPath(path string) ([]string, error) {
+	if strings.ContainsAny(path, "*?[") {
+		matches, err := filepath.Glob(path)
+		if err != nil {
+			return nil, err
+		}
+		var files []string
+		for _, match := range matches {
+			if info, err := os.Stat(match); err == nil && !info.IsDir() {
+				files = append(files, match)
+			}
+		}
+		sort.Strings(files)
+		return files, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && configExtensions[filepath.Ext(entry.Name())] {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	return files, nil
+}
+
+func (loader *configLoader) loadPath(path string) error {
+	files, err := expandConfigPath(path)
+	if err != nil {
+		return fmt.Errorf("can't read config path %s: %v", path, err)
+	}
+	for _, filename := range files {
+		if err := loader.loadFile(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (loader *configLoader) loadFile(filename string) error {
+	absPath, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if loader.loading[absPath] {
+		return fmt.Errorf("config file %s includes itself", filename)
+	}
+	if loader.loaded[absPath] {
+		return nil
+	}
+	loader.loading[absPath] = true
+	defer delete(loader.loading, absPath)
+
+	zap.L().Named("config").Debug("reading config file", zap.String("filename", filename))
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("can't open config file %s: %v", filename, err)
+	}
+	data, err = expandConfig(data)
+	if err != nil {
+		return fmt.Errorf("config file %s substitution error: %v", filename, err)
+	}
+
+	config := &Config{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.SetStrict(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s parse error: %v", filename, err)
+	}
+
+	if err := loader.merge(config, filename); err != nil {
+		return err
+	}
+	loader.loaded[absPath] = true
+
+	// the included paths are relative to the including file
+	for _, include := range config.Include {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(filename), include)
+		}
+		if err := loader.loadPath(include); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claim records the file defining the entry, it's an error if another file has defined it
+func (loader *configLoader) claim(entry, filename string) error {
+	if origin, ok := loader.origins[entry]; ok {
+		return fmt.Errorf("%s is defined in both %s and %s", entry, origin, filename)
+	}
+	loader.origins[entry] = filename
+	return nil
+}
+
+// merge merges the config of a file into the loaded config
+func (loader *configLoader) merge(src *Config, filename string) error {
+	dst := loader.config
+
+	if src.Log != nil {
+		if err := loader.claim("log", filename); err != nil {
+			return err
+		}
+		dst.Log = src.Log
+	}
+	if src.CNAMEInspection != nil {
+		if err := loader.claim("cname_inspection", filename); err != nil {
+			return err
+		}
+		dst.CNAMEInspection = src.CNAMEInspection
+	}
+	if src.RebindProtection != nil {
+		if err := loader.claim("rebind_protection", filename); err != nil {
+			return err
+		}
+		dst.RebindProtection = src.RebindProtection
+	}
+
+	dst.Listen = append(dst.Listen, src.Listen...)
+	dst.Rules = append(dst.Rules, src.Rules...)
+	dst.ResponseRules = append(dst.ResponseRules, src.ResponseRules...)
+
+	if err := loader.mergeUpstreams(&dst.Upstreams, src.Upstreams, "upstream", filename); err != nil {
+		return err
+	}
+	for name, entries := range src.IPSets {
+		if err := loader.claim("ip set "+name, filename); err != nil {
+			return err
+		}
+		if dst.IPSets == nil {
+			dst.IPSets = map[string][]string{}
+		}
+		dst.IPSets[name] = entries
+	}
+	for name, schedule := range src.Schedules {
+		if err := loader.claim("schedule "+name, filename); err != nil {
+			return err
+		}
+		if dst.Schedules == nil {
+			dst.Schedules = map[string]*ScheduleConfig{}
+		}
+		dst.Schedules[name] = schedule
+	}
+
+	for name, srcView := range src.Views {
+		if dst.Views == nil {
+			dst.Views = map[string]*ViewConfig{}
+		}
+		dstView, ok := dst.Views[name]
+		if !ok {
+			dstView = &ViewConfig{}
+			dst.Views[name] = dstView
+		}
+		if srcView == nil {
+			continue
+		}
+
+		if srcView.CNAMEInspection != nil {
+			if err := loader.claim("view "+name+" cname_inspection", filename); err != nil {
+				return err
+			}
+			dstView.CNAMEInspection = srcView.CNAMEInspection
+		}
+		if srcView.RebindProtection != nil {
+			if err := loader.claim("view "+name+" rebind_protection", filename); err != nil {
+				return err
+			}
+			dstView.RebindProtection = srcView.RebindProtection
+		}
+		dstView.Rules = append(dstView.Rules, srcView.Rules...)
+		dstView.ResponseRules = append(dstView.ResponseRules, srcView.ResponseRules...)
+		if err := loader.mergeUpstreams(&dstView.Upstreams, srcView.Upstreams, "view "+name+" upstream", filename); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (loader *configLoader) mergeUpstreams(dst *map[string]*UpstreamConfig, src map[string]*UpstreamConfig, entry, filename string) error {
+	for name, upstream := range src {
+		if err := loader.claim(entry+" "+name, filename); err != nil {
+			return err
+		}
+		if *dst == nil {
+			*dst = map[string]*UpstreamConfig{}
+		}
+		(*dst)[name] = upstream
+	}
+	return nil
+}
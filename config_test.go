@@ -0,0 +1,104 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	ta := assert.New(t)
+
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		filename := filepath.Join(dir, name)
+		ta.Nil(os.MkdirAll(filepath.Dir(filename), 0755))
+		ta.Nil(os.WriteFile(filename, []byte(content), 0644))
+		return filename
+	}
+
+	base := write("base.yml", `
+include: conf.d
+listen:
+  - type: udp
+    address: 127.0.0.1:53
+upstreams:
+  public:
+    type: dns
+    address: 8.8.8.8:53
+rules:
+  - fqdn:base.example public
+`)
+	write("conf.d/20-team-b.yaml", `
+rules:
+  - suffix:b.example public
+views:
+  vpn:
+    rules:
+      - suffix:vpn.example public
+`)
+	write("conf.d/10-team-a.yml", `
+upstreams:
+  team-a:
+    type: dns
+    address: 10.0.0.53:53
+rules:
+  - suffix:a.example team-a
+views:
+  vpn:
+    upstreams:
+      vpn-dns:
+        type: dns
+        address: 10.8.0.53:53
+    rules:
+      - wildcard:* vpn-dns
+`)
+	write("conf.d/README.md", "not a config file")
+	extra := write("extra.yml", `
+listen:
+  - type: tcp
+    address: 127.0.0.1:53
+cname_inspection: true
+`)
+
+	config, err := ReadConfig([]string{base, extra})
+	ta.Nil(err)
+	ta.Len(config.Listen, 2)
+	ta.Len(config.Upstreams, 2)
+	var rules []string
+	for _, rule := range config.Rules {
+		rules = append(rules, rule.Text)
+	}
+	ta.Equal([]string{"fqdn:base.example public", "suffix:a.example team-a", "suffix:b.example public"}, rules)
+	ta.Len(config.Views["vpn"].Upstreams, 1)
+	ta.Len(config.Views["vpn"].Rules, 2)
+	ta.True(*config.CNAMEInspection)
+
+	// a file is read only once
+	config, err = ReadConfig([]string{base, filepath.Join(dir, "conf.d")})
+	ta.Nil(err)
+	ta.Len(config.Rules, 3)
+
+	// conflicts
+	conflict := write("conflict.yml", `
+upstreams:
+  team-a:
+    type: dns
+    address: 10.0.0.54:53
+`)
+	_, err = ReadConfig([]string{base, conflict})
+	ta.EqualError(err, "upstream team-a is defined in both "+filepath.Join(dir, "conf.d/10-team-a.yml")+" and "+conflict)
+
+	_, err = ReadConfig([]string{extra, write("cname.yml", "cname_inspection: false\n")})
+	ta.NotNil(err)
+
+	// include cycles
+	write("cycle/a.yml", "include: b.yml\n")
+	write("cycle/b.yml", "include: a.yml\n")
+	_, err = ReadConfig([]string{filepath.Join(dir, "cycle/a.yml")})
+	ta.NotNil(err)
+
+	_, err = ReadConfig([]string{filepath.Join(dir, "nonexistent.yml")})
+	ta.NotNil(err)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"errors"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/ameshkov/dnsstamps"
+	"github.com/miekg/dns"
+	"sync"
+	"time"
+)
+
+// dnscryptTimeout is the read and write timeout of a DNSCrypt query
+const dnscryptTimeout = 5 * time.Second
+
+// dnscryptCertRefresh is how long before its expiration the resolver certificate is fetched again
+const dnscryptCertRefresh = time.Hour
+
+// DNSCryptClient sends DNSCrypt v2 queries over UDP, and over TCP if the answer is truncated, the resolver certificate
+// is fetched on the first query and again before it expires
+type DNSCryptClient struct {
+	stamp dnsstamps.ServerStamp
+	udp   *dnscrypt.Client
+	tcp   *dnscrypt.Client
+
+	mu       sync.Mutex
+	resolver *dnscrypt.ResolverInfo
+}
+
+// NewDNSCryptClient creates a DNSCrypt client of a sdns:// stamp
+func NewDNSCryptClient(address string) (*DNSCryptClient, error) {
+	stamp, err := dnsstamps.NewServerStampFromString(address)
+	if err != nil {
+		return nil, err
+	}
+	if stamp.Proto != dnsstamps.StampProtoTypeDNSCrypt {
+		return nil, errors.New("the stamp is not a dnscrypt one")
+	}
+	return newDNSCryptClient(stamp), nil
+}
+
+func newDNSCryptClient(stamp dnsstamps.ServerStamp) *DNSCryptClient {
+	return &DNSCryptClient{
+		stamp: stamp,
+		udp:   &dnscrypt.Client{Net: "udp", Timeout: dnscryptTimeout, UDPSize: dns.DefaultMsgSize},
+		tcp:   &dnscrypt.Client{Net: "tcp", Timeout: dnscryptTimeout},
+	}
+}
+
+// resolverInfo returns the resolver certificate and the keys, they are fetched again if the certificate expires soon
+func (c *DNSCryptClient) resolverInfo() (*dnscrypt.ResolverInfo, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resolver != nil && time.Now().Add(dnscryptCertRefresh).Unix() < int64(c.resolver.ResolverCert.NotAfter) {
+		return c.resolver, nil
+	}
+	resolver, err := c.udp.DialStamp(c.stamp)
+	if err != nil {
+		return nil, err
+	}
+	c.resolver = resolver
+	return resolver, nil
+}
+
+// drop forgets the resolver certificate if it's still the current one
+func (c *DNSCryptClient) drop(resolver *dnscrypt.ResolverInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resolver == resolver {
+		c.resolver = nil
+	}
+}
+
+// Exchange sends the encrypted request and returns the decrypted response
+func (c *DNSCryptClient) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resolver, err := c.resolverInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.udp.Exchange(req, resolver)
+	if err == nil && resp.Truncated {
+		resp, err = c.tcp.Exchange(req, resolver)
+	}
+	if err != nil {
+		// the server could have rotated its certificate, it's fetched again on the next query
+		c.drop(resolver)
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// dnscryptTestHandler answers A records, and many TXT records which don't fit in UDP
+type dnscryptTestHandler struct {
+	tcpQueries int32
+}
+
+func (h *dnscryptTestHandler) ServeDNS(rw dnscrypt.ResponseWriter, req *dns.Msg) error {
+	if _, ok := rw.(*dnscrypt.TCPResponseWriter); ok {
+		atomic.AddInt32(&h.tcpQueries, 1)
+	}
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	name := req.Question[0].Name
+	switch req.Question[0].Qtype {
+	case dns.TypeA:
+		rr, _ := dns.NewRR(name + " 300 IN A 10.0.0.4")
+		msg.Answer = append(msg.Answer, rr)
+	case dns.TypeTXT:
+		for i := 0; i < 20; i++ {
+			rr, _ := dns.NewRR(name + ` 300 IN TXT "` + strings.Repeat("x", 200) + `"`)
+			msg.Answer = append(msg.Answer, rr)
+		}
+	}
+	return rw.WriteMsg(msg)
+}
+
+func TestDNSCryptClient_Exchange(t *testing.T) {
+	ta := assert.New(t)
+
+	resolverConfig, err := dnscrypt.GenerateResolverConfig("2.dnscrypt-cert.example.org", nil)
+	ta.Nil(err)
+	cert, err := resolverConfig.CreateCert()
+	ta.Nil(err)
+	handler := &dnscryptTestHandler{}
+	server := &dnscrypt.Server{ProviderName: resolverConfig.ProviderName, ResolverCert: cert, Handler: handler}
+
+	// UDP and TCP on the same port
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	ta.Nil(err)
+	udpAddr := udpConn.LocalAddr().(*net.UDPAddr)
+	tcpListener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: udpAddr.IP, Port: udpAddr.Port})
+	if err != nil {
+		t.Skip("the udp port is in use over tcp")
+	}
+	go server.ServeUDP(udpConn)
+	go server.ServeTCP(tcpListener)
+	defer server.Shutdown(context.Background())
+
+	stamp, err := resolverConfig.CreateStamp(udpConn.LocalAddr().String())
+	ta.Nil(err)
+	client, err := NewDNSCryptClient(stamp.String())
+	ta.Nil(err)
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := client.Exchange(req)
+	ta.Nil(err)
+	ta.Equal(req.Id, resp.Id)
+	ta.Equal("10.0.0.4", resp.Answer[0].(*dns.A).A.String())
+	ta.Equal(int32(0), atomic.LoadInt32(&handler.tcpQueries))
+
+	// the truncated answers are queried again over TCP
+	req.SetQuestion("www.example.com.", dns.TypeTXT)
+	resp, err = client.Exchange(req)
+	ta.Nil(err)
+	ta.Len(resp.Answer, 20)
+	ta.Equal(int32(1), atomic.LoadInt32(&handler.tcpQueries))
+
+	_, err = NewDNSCryptClient("sdns://AgcAAAAAAAAABzEuMC4wLjEAEmRucy5jbG91ZGZsYXJlLmNvbQovZG5zLXF1ZXJ5")
+	ta.NotNil(err)
+	_, err = NewDNSCryptClient("8.8.8.8:53")
+	ta.NotNil(err)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"go.uber.org/zap"
+	"golang.org/x/net/http/httpguts"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the HTTP/3 modes of the doh upstreams
+const (
+	// HTTP3Off only uses HTTP/2 and HTTP/1.1
+	HTTP3Off = "off"
+	// HTTP3On tries HTTP/3 first and falls back to HTTP/2
+	HTTP3On = "on"
+	// HTTP3Auto uses HTTP/2 until the server advertises HTTP/3 with Alt-Svc
+	HTTP3Auto = "auto"
+)
+
+// dohContentType is the media type of the DNS-over-HTTPS messages, RFC 8484
+const dohContentType = "application/dns-message"
+
+// dohTimeout is the timeout of a DNS-over-HTTPS query
+const dohTimeout = 5 * time.Second
+
+// http3HandshakeTimeout is kept short, so the fallback to HTTP/2 is quick where UDP is blocked
+const http3HandshakeTimeout = 2 * time.Second
+
+// http3RetryInterval is how long HTTP/3 is not tried after it failed
+const http3RetryInterval = 5 * time.Minute
+
+// dohTemplatePattern matches the expressions in the RFC 6570 URI templates of the doh addresses
+var dohTemplatePattern = regexp.MustCompile(`\{[^}]*\}`)
+
+// dohForbiddenHeaders are set by the requests themselves, they can't be configured
+var dohForbiddenHeaders = map[string]bool{
+	"Content-Type":   true,
+	"Content-Length": true,
+	"Host":           true,
+}
+
+// parseDohTemplate parses a doh address, which could be a URI template like https://dns.example.com/dns-query{?dns}
+// (RFC 8484), and returns the URL without the template expression, only the dns variable is supported
+func parseDohTemplate(address string) (u *url.URL, template string, err error) {
+	expressions := dohTemplatePattern.FindAllString(address, -1)
+	switch {
+	case len(expressions) > 1:
+		return nil, "", errors.New("only one template expression is supported")
+	case len(expressions) == 1:
+		if expressions[0] != "{?dns}" && expressions[0] != "{&dns}" {
+			return nil, "", fmt.Errorf("unsupported template expression %s, must be {?dns} or {&dns}", expressions[0])
+		}
+		template = address
+		address = strings.Replace(address, expressions[0], "", 1)
+	}
+	if strings.ContainsAny(address, "{}") {
+		return nil, "", errors.New("unbalanced braces in the template")
+	}
+
+	u, err = url.Parse(address)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Host == "" {
+		return nil, "", errors.New("the url requires a host")
+	}
+	return u, template, nil
+}
+
+// newDohHeader returns the headers of the doh requests, the custom headers could override the Accept and the
+// User-Agent
+func newDohHeader(accept, userAgent string, headers map[string]string) (http.Header, error) {
+	if !httpguts.ValidHeaderFieldValue(accept) {
+		return nil, errors.New("invalid value of accept")
+	}
+	if !httpguts.ValidHeaderFieldValue(userAgent) {
+		return nil, errors.New("invalid value of user_agent")
+	}
+	header := http.Header{}
+	header.Set("Accept", accept)
+	if userAgent != "" {
+		header.Set("User-Agent", userAgent)
+	}
+	for name, value := range headers {
+		if !httpguts.ValidHeaderFieldName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if !httpguts.ValidHeaderFieldValue(value) {
+			return nil, fmt.Errorf("invalid value of header %s", name)
+		}
+		if dohForbiddenHeaders[http.CanonicalHeaderKey(name)] {
+			return nil, fmt.Errorf("header %s can't be set", name)
+		}
+		header.Set(name, value)
+	}
+	return header, nil
+}
+
+// dohClientOptions are the transport options of a doh upstream
+type dohClientOptions struct {
+	Proxy *url.URL
+	// Timeout is the timeout of a request, default: 5s
+	Timeout time.Duration
+	// HTTP3 is the HTTP/3 mode, default: off
+	HTTP3 string
+	// TLSConfig is the TLS config of the server, default: verifies the URL host
+	TLSConfig *tls.Config
+	// Bootstrap resolves the URL host, it's not used with a proxy
+	Bootstrap *Bootstrap
+}
+
+// newDohClient creates the persistent HTTP client of a doh upstream
+func newDohClient(u *url.URL, options *dohClientOptions) (*http.Client, error) {
+	tlsConfig := options.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = newUpstreamTLSConfig(u.Hostname(), nil)
+	}
+
+	h2 := &http.Transport{
+		TLSClientConfig:    tlsConfig,
+		DisableCompression: true,
+		IdleConnTimeout:    90 * time.Second,
+	}
+	if options.Proxy != nil {
+		h2.Proxy = http.ProxyURL(options.Proxy)
+	} else if options.Bootstrap != nil {
+		h2.DialContext = options.Bootstrap.DialContext
+	}
+	if err := http2.ConfigureTransport(h2); err != nil {
+		return nil, err
+	}
+
+	var transport http.RoundTripper = h2
+	switch options.HTTP3 {
+	case "", HTTP3Off:
+	case HTTP3On, HTTP3Auto:
+		if options.Proxy != nil {
+			return nil, fmt.Errorf("http3 can't be used with a proxy")
+		}
+		transport = newDohTransport(h2, tlsConfig, options.HTTP3, options.Bootstrap)
+	default:
+		return nil, fmt.Errorf("unknown http3 mode %q, must be one of %s, %s, %s", options.HTTP3, HTTP3Off, HTTP3On, HTTP3Auto)
+	}
+
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = dohTimeout
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
+
+// dohTransport sends the requests over HTTP/3 when it's available, and falls back to HTTP/2
+type dohTransport struct {
+	mode string
+	h2   http.RoundTripper
+	h3   *http3.Transport
+
+	mu sync.Mutex
+	// altSvcUntil is when the HTTP/3 alternative advertised by Alt-Svc expires, in the auto mode
+	altSvcUntil time.Time
+	// altAuthority is the host and port of the HTTP/3 alternative, an empty host or port means the origin one
+	altAuthority string
+	// brokenUntil is when HTTP/3 could be tried again after it failed
+	brokenUntil time.Time
+}
+
+func newDohTransport(h2 http.RoundTripper, tlsConfig *tls.Config, mode string, bootstrap *Bootstrap) *dohTransport {
+	t := &dohTransport{mode: mode, h2: h2}
+	t.h3 = &http3.Transport{
+		TLSClientConfig:    tlsConfig.Clone(),
+		DisableCompression: true,
+		QUICConfig: &quic.Config{
+			HandshakeIdleTimeout: http3HandshakeTimeout,
+		},
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			addr = t.http3Address(addr)
+			if bootstrap != nil {
+				var err error
+				if addr, err = bootstrap.resolveAddress(ctx, addr); err != nil {
+					return nil, err
+				}
+			}
+			return quic.DialAddrEarly(ctx, addr, tlsCfg, cfg)
+		},
+	}
+	return t
+}
+
+// http3Address replaces the origin address with the alternative authority
+func (t *dohTransport) http3Address(addr string) string {
+	t.mu.Lock()
+	authority := t.altAuthority
+	t.mu.Unlock()
+	if authority == "" {
+		return addr
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	altHost, altPort, err := net.SplitHostPort(authority)
+	if err != nil {
+		return addr
+	}
+	if altHost != "" {
+		host = altHost
+	}
+	if altPort != "" {
+		port = altPort
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// useHTTP3 returns if the next request should be sent over HTTP/3
+func (t *dohTransport) useHTTP3() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(t.brokenUntil) {
+		return false
+	}
+	return t.mode == HTTP3On || now.Before(t.altSvcUntil)
+}
+
+// RoundTrip sends the request over HTTP/3 if it's available, or over HTTP/2
+func (t *dohTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.useHTTP3() {
+		resp, err := t.h3.RoundTrip(req)
+		if err == nil {
+			return resp, nil
+		}
+		zap.L().Named("answer").Info("doh over http3 failed, falling back to http2", zap.String("host", req.URL.Host), zap.Error(err))
+		t.mu.Lock()
+		t.brokenUntil = time.Now().Add(http3RetryInterval)
+		t.mu.Unlock()
+
+		// the body is consumed by the failed request
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+
+	resp, err := t.h2.RoundTrip(req)
+	if err == nil && t.mode == HTTP3Auto {
+		t.updateAltSvc(resp.Header.Get("Alt-Svc"))
+	}
+	return resp, err
+}
+
+// updateAltSvc remembers the HTTP/3 alternative in the Alt-Svc header
+func (t *dohTransport) updateAltSvc(header string) {
+	if header == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if strings.TrimSpace(header) == "clear" {
+		t.altSvcUntil = time.Time{}
+		return
+	}
+	if authority, maxAge, ok := parseAltSvc(header); ok {
+		t.altAuthority = authority
+		t.altSvcUntil = time.Now().Add(maxAge)
+	}
+}
+
+// parseAltSvc returns the authority and the max age of the HTTP/3 alternative in an Alt-Svc header (RFC 7838), e.g.
+// h3=":443"; ma=86400, h3-29=":443"
+func parseAltSvc(header string) (authority string, maxAge time.Duration, ok bool) {
+	for _, entry := range strings.Split(header, ",") {
+		params := strings.Split(entry, ";")
+		protocol, value, found := strings.Cut(strings.TrimSpace(params[0]), "=")
+		if !found || protocol != "h3" {
+			continue
+		}
+
+		authority = strings.Trim(value, `"`)
+		// the default max age is 24 hours
+		maxAge = 24 * time.Hour
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if key != "ma" {
+				continue
+			}
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil {
+				maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+		return authority, maxAge, true
+	}
+	return "", 0, false
+}
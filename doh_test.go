@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// dohTestHandler answers the DNS-over-HTTPS POST requests, and records the HTTP major versions
+func dohTestHandler(protos chan<- int) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		protos <- r.ProtoMajor
+		buf, _ := ioutil.ReadAll(r.Body)
+		req := &dns.Msg{}
+		if err := req.Unpack(buf); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		msg := &dns.Msg{}
+		msg.SetReply(req)
+		rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 10.0.0.3")
+		msg.Answer = append(msg.Answer, rr)
+		buf, _ = msg.Pack()
+		rw.Header().Set("Content-Type", "application/dns-message")
+		rw.Write(buf)
+	})
+}
+
+func TestUpstreamDoh_HTTP3(t *testing.T) {
+	ta := assert.New(t)
+
+	cert, pool := testCertificate(t)
+	protos := make(chan int, 10)
+
+	// the HTTP/3 server
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	ta.Nil(err)
+	h3Server := &http3.Server{
+		TLSConfig: http3.ConfigureTLSConfig(&tls.Config{Certificates: []tls.Certificate{cert}}),
+		Handler:   dohTestHandler(protos),
+	}
+	go h3Server.Serve(packetConn)
+	defer h3Server.Close()
+	h3Port := packetConn.LocalAddr().(*net.UDPAddr).Port
+
+	// the HTTP/2 server advertises HTTP/3
+	h2Handler := dohTestHandler(protos)
+	h2Server := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Alt-Svc", `h3=":`+strconv.Itoa(h3Port)+`"; ma=3600`)
+		h2Handler.ServeHTTP(rw, r)
+	}))
+	h2Server.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	h2Server.EnableHTTP2 = true
+	h2Server.StartTLS()
+	defer h2Server.Close()
+
+	newUpstream := func(mode string) *UpstreamDohPost {
+		u, _ := url.Parse(h2Server.URL + "/dns-query")
+		tlsConfig := newUpstreamTLSConfig("localhost", nil)
+		tlsConfig.RootCAs = pool
+		client, err := newDohClient(u, &dohClientOptions{HTTP3: mode, TLSConfig: tlsConfig})
+		ta.Nil(err)
+		return &UpstreamDohPost{UpstreamDoh{UpstreamImpl: UpstreamImpl{name: "doh"}, url: u, client: client}}
+	}
+	query := func(upstream Upstream) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		rec := &responseRecorder{}
+		upstream.Query(rec, req)
+		return rec.msg
+	}
+
+	// auto: HTTP/2 until Alt-Svc is received
+	upstream := newUpstream(HTTP3Auto)
+	ta.Equal("10.0.0.3", query(upstream).Answer[0].(*dns.A).A.String())
+	ta.Equal(2, <-protos)
+	ta.Equal("10.0.0.3", query(upstream).Answer[0].(*dns.A).A.String())
+	ta.Equal(3, <-protos)
+
+	// on: HTTP/3 first
+	upstream = newUpstream(HTTP3On)
+	upstream.client.Transport.(*dohTransport).altAuthority = ":" + strconv.Itoa(h3Port)
+	ta.NotNil(query(upstream))
+	ta.Equal(3, <-protos)
+
+	// falls back to HTTP/2 if HTTP/3 fails
+	h3Server.Close()
+	upstream = newUpstream(HTTP3On)
+	start := time.Now()
+	ta.NotNil(query(upstream))
+	ta.Equal(2, <-protos)
+	ta.True(time.Since(start) < dohTimeout)
+	// and HTTP/3 is not tried again for a while
+	start = time.Now()
+	ta.NotNil(query(upstream))
+	ta.Equal(2, <-protos)
+	ta.True(time.Since(start) < time.Second)
+
+	dohURL := &url.URL{Scheme: "https", Host: "dns.example.com"}
+	_, err = newDohClient(dohURL, &dohClientOptions{Proxy: &url.URL{Scheme: "socks5", Host: "127.0.0.1:1080"}, HTTP3: HTTP3Auto})
+	ta.NotNil(err)
+	_, err = newDohClient(dohURL, &dohClientOptions{HTTP3: "maybe"})
+	ta.NotNil(err)
+}
+
+func TestParseAltSvc(t *testing.T) {
+	ta := assert.New(t)
+
+	authority, maxAge, ok := parseAltSvc(`h3-29=":443"; ma=60, h3=":8443"; ma=86400; persist=1`)
+	ta.True(ok)
+	ta.Equal(":8443", authority)
+	ta.Equal(24*time.Hour, maxAge)
+
+	authority, maxAge, ok = parseAltSvc(`h3="alt.example.com:443"`)
+	ta.True(ok)
+	ta.Equal("alt.example.com:443", authority)
+	ta.Equal(24*time.Hour, maxAge)
+
+	_, _, ok = parseAltSvc(`h2=":443"`)
+	ta.False(ok)
+}
+
+func TestUpstreamDoh_Options(t *testing.T) {
+	ta := assert.New(t)
+
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requests <- r
+		var buf []byte
+		if r.Method == "GET" {
+			buf, _ = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		} else {
+			buf, _ = ioutil.ReadAll(r.Body)
+		}
+		req := &dns.Msg{}
+		if err := req.Unpack(buf); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		msg := &dns.Msg{}
+		msg.SetReply(req)
+		buf, _ = msg.Pack()
+		rw.Write(buf)
+	}))
+	defer server.Close()
+
+	header, err := newDohHeader(dohContentType, "dohproxy-test", map[string]string{"Authorization": "Bearer token"})
+	ta.Nil(err)
+	newUpstream := func(address string) UpstreamDoh {
+		u, template, err := parseDohTemplate(address)
+		ta.Nil(err)
+		return UpstreamDoh{UpstreamImpl: UpstreamImpl{name: "doh"}, url: u, template: template, header: header, client: server.Client()}
+	}
+	query := func(upstream Upstream) *http.Request {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		rec := &responseRecorder{}
+		upstream.Query(rec, req)
+		ta.NotNil(rec.msg)
+		return <-requests
+	}
+
+	// the query string of the URL is kept
+	r := query(&UpstreamDohGet{newUpstream(server.URL + "/dns-query?key=value")})
+	ta.Equal("value", r.URL.Query().Get("key"))
+	ta.NotEmpty(r.URL.Query().Get("dns"))
+	ta.Equal("Bearer token", r.Header.Get("Authorization"))
+	ta.Equal("dohproxy-test", r.Header.Get("User-Agent"))
+	ta.Equal(dohContentType, r.Header.Get("Accept"))
+
+	r = query(&UpstreamDohGet{newUpstream(server.URL + "/q{?dns}")})
+	ta.Equal("/q", r.URL.Path)
+	ta.NotEmpty(r.URL.Query().Get("dns"))
+	r = query(&UpstreamDohGet{newUpstream(server.URL + "/q?key=value{&dns}")})
+	ta.Equal("value", r.URL.Query().Get("key"))
+	ta.NotEmpty(r.URL.Query().Get("dns"))
+
+	// the template expression is removed from the POST URL
+	r = query(&UpstreamDohPost{newUpstream(server.URL + "/q{?dns}")})
+	ta.Equal("/q", r.URL.Path)
+	ta.Empty(r.URL.RawQuery)
+	ta.Equal(dohContentType, r.Header.Get("Content-Type"))
+
+	for _, address := range []string{"https://dns.example.com/q{?name}", "https://dns.example.com/q{?dns}{&dns}", "https://dns.example.com/q{?dns", "/dns-query"} {
+		_, _, err := parseDohTemplate(address)
+		ta.NotNil(err, address)
+	}
+	for _, headers := range []map[string]string{{"Content-Type": "text/plain"}, {"host": "dns.example.com"}, {"Bad Name": "x"}, {"X-Value": "a\nb"}} {
+		_, err := newDohHeader(dohContentType, "", headers)
+		ta.NotNil(err, headers)
+	}
+	_, err = newDohHeader("application/dns-message\r\nX-Injected: 1", "", nil)
+	ta.NotNil(err)
+	_, err = newDohHeader(dohContentType, "dohproxy\n", nil)
+	ta.NotNil(err)
+}
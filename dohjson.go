@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// dohJSONAccept is the Accept header of the JSON API requests, some HTTP proxies only allow application/json
+const dohJSONAccept = "application/dns-json, application/json"
+
+// dohJSONResponse is the answer of the Google and Cloudflare JSON API
+type dohJSONResponse struct {
+	Status     int
+	TC         bool
+	RD         bool
+	RA         bool
+	AD         bool
+	CD         bool
+	Answer     []dohJSONRecord
+	Authority  []dohJSONRecord
+	Additional []dohJSONRecord
+}
+
+// dohJSONRecord is a resource record in the JSON API answer
+type dohJSONRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// dohJSONURL returns the JSON API URL of the request, the query string of the upstream URL is kept
+func dohJSONURL(u *url.URL, req *dns.Msg) string {
+	question := req.Question[0]
+	query := u.Query()
+	query.Set("name", question.Name)
+	query.Set("type", strconv.Itoa(int(question.Qtype)))
+	if opt := req.IsEdns0(); opt != nil && opt.Do() {
+		query.Set("do", "1")
+	}
+	if req.CheckingDisabled {
+		query.Set("cd", "1")
+	}
+
+	jsonURL := *u
+	jsonURL.RawQuery = query.Encode()
+	return jsonURL.String()
+}
+
+// dohJSONToMsg converts the JSON API answer into the reply of the request, the records which can't be parsed are
+// left out
+func dohJSONToMsg(req *dns.Msg, body []byte) (*dns.Msg, error) {
+	resp := &dohJSONResponse{}
+	if err := json.Unmarshal(body, resp); err != nil {
+		return nil, err
+	}
+
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	msg.Rcode = resp.Status
+	msg.Truncated = resp.TC
+	msg.RecursionDesired = resp.RD
+	msg.RecursionAvailable = resp.RA
+	msg.AuthenticatedData = resp.AD
+	msg.CheckingDisabled = resp.CD
+	msg.Answer = dohJSONRecords(resp.Answer)
+	msg.Ns = dohJSONRecords(resp.Authority)
+	msg.Extra = dohJSONRecords(resp.Additional)
+	return msg, nil
+}
+
+func dohJSONRecords(records []dohJSONRecord) []dns.RR {
+	var rrs []dns.RR
+	for _, record := range records {
+		rr, err := dohJSONRecordToRR(record)
+		if err != nil {
+			zap.L().Named("answer").Debug("doh json record parse error", zap.String("name", record.Name), zap.Uint16("type", record.Type), zap.Error(err))
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
+
+func dohJSONRecordToRR(record dohJSONRecord) (dns.RR, error) {
+	typeName, ok := dns.TypeToString[record.Type]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %d", record.Type)
+	}
+	data := record.Data
+	// the TXT data is quoted by Google and Cloudflare, but not by all the servers
+	if record.Type == dns.TypeTXT && !strings.HasPrefix(data, `"`) {
+		data = strconv.Quote(data)
+	}
+	return dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(record.Name), record.TTL, typeName, data))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestUpstreamDohJSON_Query(t *testing.T) {
+	ta := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Header.Get("Accept") != dohJSONAccept || query.Get("key") != "value" || query.Get("type") != "16" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{
+			"Status": 0, "TC": false, "RD": true, "RA": true, "AD": true, "CD": false,
+			"Question": [{"name": "` + query.Get("name") + `", "type": 16}],
+			"Answer": [
+				{"name": "www.example.com.", "type": 5, "TTL": 60, "data": "example.com."},
+				{"name": "example.com.", "type": 16, "TTL": 300, "data": "\"v=spf1 -all\""},
+				{"name": "example.com.", "type": 16, "TTL": 300, "data": "hello world"},
+				{"name": "example.com.", "type": 65280, "TTL": 300, "data": "unknown"}
+			],
+			"Comment": "Response from 192.0.2.1."
+		}`))
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL + "/resolve?key=value")
+	header, err := newDohHeader(dohJSONAccept, "", nil)
+	ta.Nil(err)
+	upstream := &UpstreamDohJSON{UpstreamDoh{UpstreamImpl: UpstreamImpl{name: "json"}, url: u, header: header, client: server.Client()}}
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeTXT)
+	rec := &responseRecorder{}
+	upstream.Query(rec, req)
+	if ta.NotNil(rec.msg) {
+		ta.Equal(req.Id, rec.msg.Id)
+		ta.Equal(dns.RcodeSuccess, rec.msg.Rcode)
+		ta.True(rec.msg.AuthenticatedData)
+		if ta.Len(rec.msg.Answer, 3) {
+			ta.Equal("example.com.", rec.msg.Answer[0].(*dns.CNAME).Target)
+			ta.Equal([]string{"v=spf1 -all"}, rec.msg.Answer[1].(*dns.TXT).Txt)
+			ta.Equal([]string{"hello world"}, rec.msg.Answer[2].(*dns.TXT).Txt)
+		}
+	}
+
+	msg, err := dohJSONToMsg(req, []byte(`{"Status": 3}`))
+	ta.Nil(err)
+	ta.Equal(dns.RcodeNameError, msg.Rcode)
+	_, err = dohJSONToMsg(req, []byte(`<html>`))
+	ta.NotNil(err)
+
+	req.SetEdns0(4096, true)
+	req.CheckingDisabled = true
+	jsonURL, _ := url.Parse(dohJSONURL(u, req))
+	ta.Equal("www.example.com.", jsonURL.Query().Get("name"))
+	ta.Equal("1", jsonURL.Query().Get("do"))
+	ta.Equal("1", jsonURL.Query().Get("cd"))
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// doqALPN is the application protocol of DNS-over-QUIC, RFC 9250
+const doqALPN = "doq"
+
+// doqDefaultPort is the default DNS-over-QUIC port
+const doqDefaultPort = "853"
+
+// doqTimeout is the timeout of a DNS-over-QUIC query, including the connection
+const doqTimeout = 5 * time.Second
+
+// writeDoQMessage writes the message with the 2 bytes length prefix
+func writeDoQMessage(w io.Writer, msg *dns.Msg) error {
+	buf, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	packet := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(packet, uint16(len(buf)))
+	copy(packet[2:], buf)
+	_, err = w.Write(packet)
+	return err
+}
+
+// readDoQMessage reads a message with the 2 bytes length prefix
+func readDoQMessage(r io.Reader) (*dns.Msg, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	msg := &dns.Msg{}
+	if err := msg.Unpack(buf); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// DoQClient sends DNS-over-QUIC queries, the connection is reused with one stream per query, and resumed with 0-RTT
+// when the server supports it
+type DoQClient struct {
+	address    string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	bootstrap  *Bootstrap
+
+	mu   sync.Mutex
+	conn quic.EarlyConnection
+}
+
+// NewDoQClient creates a DNS-over-QUIC client, the address is like dns.example.com, quic://dns.example.com:853 or
+// 9.9.9.9, the default port is 853, the host of the address is verified if the tlsConfig has no server name
+func NewDoQClient(address string, tlsConfig *tls.Config, bootstrap *Bootstrap) (*DoQClient, error) {
+	host, port, err := splitUpstreamAddress(address, "quic://", doqDefaultPort)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig == nil {
+		tlsConfig = newUpstreamTLSConfig(host, nil)
+	}
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	tlsConfig.NextProtos = []string{doqALPN}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	return &DoQClient{
+		address:   net.JoinHostPort(host, port),
+		tlsConfig: tlsConfig,
+		quicConfig: &quic.Config{
+			KeepAlivePeriod: 20 * time.Second,
+		},
+		bootstrap: bootstrap,
+	}, nil
+}
+
+// connection returns the open connection, or dials a new one, fresh tells if the connection is just dialed
+func (c *DoQClient) connection(ctx context.Context) (conn quic.EarlyConnection, fresh bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil && c.conn.Context().Err() == nil {
+		return c.conn, false, nil
+	}
+	address, err := c.bootstrap.resolveAddress(ctx, c.address)
+	if err != nil {
+		return nil, false, err
+	}
+	conn, err = quic.DialAddrEarly(ctx, address, c.tlsConfig, c.quicConfig)
+	if err != nil {
+		return nil, false, err
+	}
+	c.conn = conn
+	return conn, true, nil
+}
+
+// drop closes the connection if it's still the current one
+func (c *DoQClient) drop(conn quic.EarlyConnection) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == conn {
+		c.conn = nil
+	}
+	conn.CloseWithError(0, "")
+}
+
+// Exchange sends the request and returns the response, a request failed on a reused connection is retried once on a
+// new connection as the server could have closed it
+func (c *DoQClient) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), doqTimeout)
+	defer cancel()
+
+	for {
+		conn, fresh, err := c.connection(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.exchange(ctx, conn, req)
+		if err == nil {
+			return resp, nil
+		}
+		c.drop(conn)
+		if fresh || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *DoQClient) exchange(ctx context.Context, conn quic.EarlyConnection, req *dns.Msg) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	// the message id must be 0 over QUIC
+	msg := req.Copy()
+	msg.Id = 0
+	if err := writeDoQMessage(stream, msg); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	// the client closes the sending direction after the query
+	stream.Close()
+
+	resp, err := readDoQMessage(stream)
+	if err != nil {
+		return nil, err
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// doqResponseWriter writes the answer to a DNS-over-QUIC stream
+type doqResponseWriter struct {
+	conn    quic.Connection
+	stream  quic.Stream
+	written bool
+}
+
+// LocalAddr returns the local address of the connection
+func (w *doqResponseWriter) LocalAddr() net.Addr {
+	return w.conn.LocalAddr()
+}
+
+// RemoteAddr returns the client address of the connection
+func (w *doqResponseWriter) RemoteAddr() net.Addr {
+	return w.conn.RemoteAddr()
+}
+
+// WriteMsg writes the answer with the 2 bytes length prefix and closes the stream
+func (w *doqResponseWriter) WriteMsg(msg *dns.Msg) error {
+	// the message id must be 0 over QUIC
+	msg.Id = 0
+	w.written = true
+	defer w.stream.Close()
+	return writeDoQMessage(w.stream, msg)
+}
+
+// Write writes the answer in wire format
+func (w *doqResponseWriter) Write(buf []byte) (int, error) {
+	msg := &dns.Msg{}
+	if err := msg.Unpack(buf); err != nil {
+		return 0, err
+	}
+	return len(buf), w.WriteMsg(msg)
+}
+
+// Close closes the stream, or resets it if nothing is written, e.g. the request is dropped by a black hole
+func (w *doqResponseWriter) Close() error {
+	if !w.written {
+		w.stream.CancelWrite(doqNoError)
+		return nil
+	}
+	return w.stream.Close()
+}
+
+// TsigStatus returns nil, TSIG is not supported over QUIC
+func (w *doqResponseWriter) TsigStatus() error {
+	return nil
+}
+
+// TsigTimersOnly does nothing
+func (w *doqResponseWriter) TsigTimersOnly(bool) {}
+
+// Hijack does nothing
+func (w *doqResponseWriter) Hijack() {}
+
+// the DNS-over-QUIC error codes
+const (
+	// doqNoError is the DOQ_NO_ERROR error code
+	doqNoError = 0x0
+	// doqProtocolError is the DOQ_PROTOCOL_ERROR error code
+	doqProtocolError = 0x2
+)
+
+// serveDoQConn serves the queries on the streams of a DNS-over-QUIC connection, every stream has one query
+func serveDoQConn(conn quic.Connection, handler dns.Handler) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			stream.SetReadDeadline(time.Now().Add(doqTimeout))
+			req, err := readDoQMessage(stream)
+			if err != nil || len(req.Question) == 0 {
+				stream.CancelRead(doqProtocolError)
+				stream.CancelWrite(doqProtocolError)
+				return
+			}
+			// a query with a non-zero message id is a protocol error
+			if req.Id != 0 {
+				conn.CloseWithError(doqProtocolError, "non-zero message id")
+				return
+			}
+
+			handler.ServeDNS(&doqResponseWriter{conn: conn, stream: stream}, req)
+		}()
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+	"github.com/stretchr/testify/assert"
+	"math/big"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCertificate creates a self-signed server and client certificate of localhost and 127.0.0.1, and the pool
+// trusting it
+func testCertificate(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestDoQClient_Exchange(t *testing.T) {
+	ta := assert.New(t)
+
+	cert, pool := testCertificate(t)
+	listener, err := quic.ListenAddrEarly("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{doqALPN},
+	}, &quic.Config{Allow0RTT: true})
+	ta.Nil(err)
+	defer listener.Close()
+
+	var conns, zeroIDs int32
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					req, err := readDoQMessage(stream)
+					if err != nil {
+						return
+					}
+					if req.Id == 0 {
+						atomic.AddInt32(&zeroIDs, 1)
+					}
+					msg := &dns.Msg{}
+					msg.SetReply(req)
+					rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 10.0.0.1")
+					msg.Answer = append(msg.Answer, rr)
+					writeDoQMessage(stream, msg)
+					stream.Close()
+				}
+			}()
+		}
+	}()
+
+	client, err := NewDoQClient("quic://"+listener.Addr().String(), nil, nil)
+	ta.Nil(err)
+	client.tlsConfig.ServerName = "localhost"
+	client.tlsConfig.RootCAs = pool
+
+	for i := 0; i < 3; i++ {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		resp, err := client.Exchange(req)
+		ta.Nil(err)
+		ta.Equal(req.Id, resp.Id)
+		ta.Equal("10.0.0.1", resp.Answer[0].(*dns.A).A.String())
+	}
+	ta.Equal(int32(1), atomic.LoadInt32(&conns))
+	ta.Equal(int32(3), atomic.LoadInt32(&zeroIDs))
+
+	// the closed connection is replaced, and the TLS session is resumed
+	client.conn.CloseWithError(0, "")
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = client.Exchange(req)
+	ta.Nil(err)
+	ta.Equal(int32(2), atomic.LoadInt32(&conns))
+	ta.True(client.conn.ConnectionState().TLS.DidResume)
+
+	for _, address := range []string{"dns.example.com", "dns.example.com:8853", "9.9.9.9", "[2620:fe::fe]:853"} {
+		client, err := NewDoQClient(address, nil, nil)
+		ta.Nil(err, address)
+		_, port, _ := net.SplitHostPort(client.address)
+		ta.NotEmpty(port)
+	}
+	_, err = NewDoQClient("quic://:853", nil, nil)
+	ta.NotNil(err)
+}
+
+func TestDoQServer_Serve(t *testing.T) {
+	ta := assert.New(t)
+
+	handler := NewHandler("default")
+	handler.AddRule("fqdn:www.example.com 10.0.0.2")
+	handler.AddRule("suffix:never-response.com blackhole")
+
+	cert, pool := testCertificate(t)
+	server := &DoQServer{
+		ServerImpl: ServerImpl{name: "doq-test", handler: handler},
+		tlsConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{doqALPN},
+		},
+	}
+	listener, err := quic.ListenAddrEarly("127.0.0.1:0", server.tlsConfig, &quic.Config{Allow0RTT: true})
+	ta.Nil(err)
+	defer listener.Close()
+	go server.serve(listener)
+
+	client, err := NewDoQClient(listener.Addr().String(), nil, nil)
+	ta.Nil(err)
+	client.tlsConfig.RootCAs = pool
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	resp, err := client.Exchange(req)
+	ta.Nil(err)
+	ta.Equal(req.Id, resp.Id)
+	ta.True(resp.Authoritative)
+	ta.Equal("10.0.0.2", resp.Answer[0].(*dns.A).A.String())
+
+	// the dropped requests reset the stream instead of closing it
+	req.SetQuestion("www.never-response.com.", dns.TypeA)
+	_, err = client.Exchange(req)
+	var streamErr *quic.StreamError
+	if ta.True(errors.As(err, &streamErr), "%v", err) {
+		ta.Equal(quic.StreamErrorCode(doqNoError), streamErr.ErrorCode)
+		ta.True(streamErr.Remote)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/miekg/dns"
+	"net"
+	"time"
+)
+
+// dotDefaultPort is the default DNS-over-TLS port
+const dotDefaultPort = "853"
+
+// dotTimeout is the timeout of a DNS-over-TLS query, including the connection
+const dotTimeout = 5 * time.Second
+
+// DoTClient sends DNS-over-TLS queries, RFC 7858
+type DoTClient struct {
+	address   string
+	client    *dns.Client
+	bootstrap *Bootstrap
+}
+
+// NewDoTClient creates a DNS-over-TLS client, the address is like dns.example.com, tls://dns.example.com:853 or
+// 9.9.9.9, the default port is 853, the host of the address is verified if the tlsConfig has no server name
+func NewDoTClient(address string, tlsConfig *tls.Config, bootstrap *Bootstrap) (*DoTClient, error) {
+	host, port, err := splitUpstreamAddress(address, "tls://", dotDefaultPort)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig == nil {
+		tlsConfig = newUpstreamTLSConfig(host, nil)
+	} else if tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName = host
+	}
+
+	return &DoTClient{
+		address: net.JoinHostPort(host, port),
+		client: &dns.Client{
+			Net:       "tcp-tls",
+			TLSConfig: tlsConfig,
+			Timeout:   dotTimeout,
+		},
+		bootstrap: bootstrap,
+	}, nil
+}
+
+// Exchange sends the request and returns the response, the host is resolved by the bootstrap and the certificate is
+// still verified against the host name
+func (c *DoTClient) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dotTimeout)
+	defer cancel()
+
+	address, err := c.bootstrap.resolveAddress(ctx, c.address)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := c.client.ExchangeContext(ctx, req, address)
+	return resp, err
+}
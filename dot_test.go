@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+func TestDoTClient_Exchange(t *testing.T) {
+	ta := assert.New(t)
+
+	cert, pool := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	ta.Nil(err)
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			msg := &dns.Msg{}
+			msg.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 10.0.0.5")
+			msg.Answer = append(msg.Answer, rr)
+			w.WriteMsg(msg)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	// the host name is resolved by the bootstrap, and the certificate is verified against the server name
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	address := "tls://dns.test:" + port
+	bootstrap := NewBootstrap(nil, "dns.test", []net.IP{net.IPv4(127, 0, 0, 1)})
+	hash := sha256.Sum256(cert.Leaf.RawTBSCertificate)
+
+	query := func(certHashes [][]byte) (*dns.Msg, error) {
+		tlsConfig := newUpstreamTLSConfig("localhost", certHashes)
+		tlsConfig.RootCAs = pool
+		client, err := NewDoTClient(address, tlsConfig, bootstrap)
+		ta.Nil(err)
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		return client.Exchange(req)
+	}
+
+	resp, err := query(nil)
+	ta.Nil(err)
+	ta.Equal("10.0.0.5", resp.Answer[0].(*dns.A).A.String())
+	_, err = query([][]byte{hash[:]})
+	ta.Nil(err)
+	_, err = query([][]byte{make([]byte, sha256.Size)})
+	ta.NotNil(err)
+
+	// no bootstrap address is an error
+	client, err := NewDoTClient(address, nil, NewBootstrap([]string{"127.0.0.1:1"}, "", nil))
+	ta.Nil(err)
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = client.Exchange(req)
+	ta.NotNil(err)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	yaml3 "gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// expandPattern matches ${NAME}, ${NAME:-default} and ${file:/path}, $${ is the escaped ${
+var expandPattern = regexp.MustCompile(`\$?\$\{([^}]*)\}`)
+
+// expandConfig replaces the environment variables and the secret files in the scalar values of the config file
+// content, the comments and the keys are left alone, and the rest of the content is kept as it is
+//
+//   - ${NAME}: the environment variable, it's an error if the variable is not set
+//   - ${NAME:-default}: the environment variable, or the default if the variable is not set or empty
+//   - ${file:/run/secrets/token}: the file content without the trailing newlines
+//   - $${NAME}: the literal ${NAME}
+//
+// The value is written as it is into a plain scalar if it's safe there, e.g. ttl: ${TTL} is still a number, otherwise
+// the scalar is replaced with a double-quoted string, so the values never change the YAML structure.
+func expandConfig(data []byte) ([]byte, error) {
+	if !expandPattern.Match(data) {
+		return data, nil
+	}
+
+	root := &yaml3.Node{}
+	if err := yaml3.Unmarshal(data, root); err != nil {
+		return nil, err
+	}
+	var scalars []*yaml3.Node
+	collectValueScalars(root, &scalars)
+
+	// the line offsets, the node positions are 1-based lines and runes
+	lineStarts := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			lineStarts = append(lineStarts, i+1)
+		}
+	}
+
+	type replacement struct {
+		start, end int
+		text       string
+	}
+	var replacements []replacement
+	for _, node := range scalars {
+		if !expandPattern.MatchString(node.Value) {
+			continue
+		}
+		expanded, err := expandScalar(node.Value)
+		if err != nil {
+			return nil, err
+		}
+		start := lineStarts[node.Line-1]
+		start += len(string([]rune(string(data[start:]))[:node.Column-1]))
+		end, err := scalarEnd(data, start, node)
+		if err != nil {
+			return nil, err
+		}
+		text := strconv.Quote(expanded)
+		if node.Style == 0 && plainSafePattern.MatchString(expanded) {
+			text = expanded
+		}
+		replacements = append(replacements, replacement{start: start, end: end, text: text})
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	for _, r := range replacements {
+		buf.Write(data[last:r.start])
+		buf.WriteString(r.text)
+		last = r.end
+	}
+	buf.Write(data[last:])
+	return buf.Bytes(), nil
+}
+
+// plainSafePattern matches the values which are written into the plain scalars as they are
+var plainSafePattern = regexp.MustCompile(`^[A-Za-z0-9_./+=~-]([A-Za-z0-9_./+=~:?&@%-]*[A-Za-z0-9_./+=~?&@%-])?$`)
+
+// collectValueScalars appends the scalar nodes which are not mapping keys in the document order
+func collectValueScalars(node *yaml3.Node, scalars *[]*yaml3.Node) {
+	switch node.Kind {
+	case yaml3.ScalarNode:
+		*scalars = append(*scalars, node)
+	case yaml3.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			collectValueScalars(node.Content[i], scalars)
+		}
+	default:
+		for _, child := range node.Content {
+			collectValueScalars(child, scalars)
+		}
+	}
+}
+
+// scalarEnd returns the end offset of the scalar starting at the offset
+func scalarEnd(data []byte, start int, node *yaml3.Node) (int, error) {
+	switch node.Style {
+	case 0:
+		if !bytes.HasPrefix(data[start:], []byte(node.Value)) {
+			return 0, fmt.Errorf("line %d: can't find the value with variables, quote it in one line without anchors or tags", node.Line)
+		}
+		return start + len(node.Value), nil
+	case yaml3.DoubleQuotedStyle:
+		if data[start] != '"' {
+			return 0, fmt.Errorf("line %d: variables in the values with anchors or tags are not supported", node.Line)
+		}
+		for i := start + 1; i < len(data); i++ {
+			switch data[i] {
+			case '\\':
+				i++
+			case '"':
+				return i + 1, nil
+			}
+		}
+	case yaml3.SingleQuotedStyle:
+		if data[start] != '\'' {
+			return 0, fmt.Errorf("line %d: variables in the values with anchors or tags are not supported", node.Line)
+		}
+		for i := start + 1; i < len(data); i++ {
+			if data[i] == '\'' {
+				if i+1 < len(data) && data[i+1] == '\'' {
+					i++
+					continue
+				}
+				return i + 1, nil
+			}
+		}
+	default:
+		return 0, fmt.Errorf("line %d: variables in the block scalars are not supported", node.Line)
+	}
+	return 0, fmt.Errorf("line %d: unterminated quoted value", node.Line)
+}
+
+// expandScalar returns the scalar value with the variables replaced
+func expandScalar(scalar string) (string, error) {
+	var expandErr error
+	expanded := expandPattern.ReplaceAllStringFunc(scalar, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		value, err := expandVariable(expandPattern.FindStringSubmatch(match)[1])
+		if err != nil && expandErr == nil {
+			expandErr = err
+		}
+		return value
+	})
+	return expanded, expandErr
+}
+
+// expandVariable returns the value of the expression in ${}
+func expandVariable(expression string) (string, error) {
+	if strings.HasPrefix(expression, "file:") {
+		filename := strings.TrimPrefix(expression, "file:")
+		content, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return "", fmt.Errorf("read secret file failed: %v", err)
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	name, defaultValue, hasDefault := strings.Cut(expression, ":-")
+	if name == "" {
+		return "", fmt.Errorf("invalid variable ${%s}", expression)
+	}
+	value, ok := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return defaultValue, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandConfig(t *testing.T) {
+	ta := assert.New(t)
+
+	secret := filepath.Join(t.TempDir(), "token")
+	ta.Nil(os.WriteFile(secret, []byte("s3cr3t\n"), 0600))
+	t.Setenv("DOHPROXY_LISTEN", "0.0.0.0:5353")
+	t.Setenv("DOHPROXY_EMPTY", "")
+	t.Setenv("DOHPROXY_TTL", "300")
+	t.Setenv("DOHPROXY_INJECT", "x\nrules: [wildcard:* evil]")
+	t.Setenv("DOHPROXY_HASH", "a #b")
+
+	expanded, err := expandConfig([]byte(`listen:
+  - type: udp
+    address: ${DOHPROXY_LISTEN}
+upstreams:
+  doh:
+    type: doh-post
+    address: https://dns.example.com/${file:` + secret + `}/dns-query
+    proxy: ${DOHPROXY_PROXY:-socks5://127.0.0.1:1080}
+    origin: '${DOHPROXY_EMPTY:-home.lan}'
+    ttl: ${DOHPROXY_TTL}   # ${DOHPROXY_UNSET} in the comments is kept
+    user_agent: "${DOHPROXY_INJECT}"
+    accept: ${DOHPROXY_HASH}
+    headers: {X-Literal: "$${DOHPROXY_LISTEN}", X-Token: "${DOHPROXY_TTL}"}
+`))
+	ta.Nil(err)
+	ta.Equal(`listen:
+  - type: udp
+    address: 0.0.0.0:5353
+upstreams:
+  doh:
+    type: doh-post
+    address: https://dns.example.com/s3cr3t/dns-query
+    proxy: socks5://127.0.0.1:1080
+    origin: "home.lan"
+    ttl: 300   # ${DOHPROXY_UNSET} in the comments is kept
+    user_agent: "x\nrules: [wildcard:* evil]"
+    accept: "a #b"
+    headers: {X-Literal: "${DOHPROXY_LISTEN}", X-Token: "300"}
+`, string(expanded))
+
+	for _, text := range []string{
+		"address: ${DOHPROXY_UNSET}",
+		"address: ${file:/nonexistent/secret}",
+		"address: ${}",
+		"address: |\n  ${DOHPROXY_TTL}\n",
+	} {
+		_, err := expandConfig([]byte(text))
+		ta.NotNil(err, text)
+	}
+}
+
+func TestReadConfig_Expand(t *testing.T) {
+	ta := assert.New(t)
+
+	t.Setenv("DOHPROXY_ADDRESS", "https://dns.example.com/dns-query")
+	read := func(content string) (*Config, error) {
+		filename := filepath.Join(t.TempDir(), "dohproxy.yml")
+		ta.Nil(os.WriteFile(filename, []byte(content), 0644))
+		return ReadConfig([]string{filename})
+	}
+
+	// the other values are decoded as if there were no variables
+	config, err := read(`upstreams:
+  doh:
+    type: doh
+    address: ${DOHPROXY_ADDRESS}
+    http3: on
+    tls:
+      min_version: 1.0
+`)
+	ta.Nil(err)
+	ta.Equal("https://dns.example.com/dns-query", config.Upstreams["doh"].Address)
+	ta.Equal("on", config.Upstreams["doh"].HTTP3)
+	ta.Equal("1.0", config.Upstreams["doh"].TLS.MinVersion)
+
+	// the duplicate keys are still errors, on the same line as without the variables
+	duplicate := `upstreams:
+  a:
+    type: doh
+    address: %s
+  a:
+    type: dns
+    address: 8.8.8.8:53
+`
+	_, err = read(strings.Replace(duplicate, "%s", "${DOHPROXY_ADDRESS}", 1))
+	_, literalErr := read(strings.Replace(duplicate, "%s", "https://dns.example.com/dns-query", 1))
+	if ta.NotNil(err) && ta.NotNil(literalErr) {
+		ta.Contains(err.Error(), `key "a" already set in map`)
+		ta.Equal(literalErr.Error()[strings.Index(literalErr.Error(), "parse error"):], err.Error()[strings.Index(err.Error(), "parse error"):])
+	}
+}
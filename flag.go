@@ -6,6 +6,17 @@ import (
 	"strings"
 )
 
+// defaultConfigPath is used if no config is set
+const defaultConfigPath = "/etc/dohproxy.yml"
+
+// getConfigPaths returns the config files and directories set by the flags in order
+func getConfigPaths(c *cli.Context) []string {
+	if paths := c.StringSlice("config"); len(paths) > 0 {
+		return paths
+	}
+	return []string{defaultConfigPath}
+}
+
 func getApp() *cli.App {
 	app := cli.NewApp()
 	app.Name = Name
@@ -18,10 +29,13 @@ func getApp() *cli.App {
 			Usage: "show help",
 		},
 		cli.VersionFlag,
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:  "config, c",
-			Usage: "set config file",
-			Value: "/etc/dohproxy.yml",
+			Usage: "set config file or directory, could be repeated, default: " + defaultConfigPath,
+		},
+		cli.BoolFlag{
+			Name:  "check",
+			Usage: "check the config file and show which rules are active now",
 		},
 		cli.StringFlag{
 			Name:  "service, s",
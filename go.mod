@@ -1,22 +1,46 @@
 module github.com/major1201/dohproxy
 
+go 1.22
+
 require (
+	github.com/ameshkov/dnscrypt/v2 v2.3.0
+	github.com/ameshkov/dnsstamps v1.0.3
+	github.com/cloudflare/circl v1.3.7
 	github.com/go-yaml/yaml v2.1.0+incompatible
-	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
 	github.com/kardianos/service v0.0.0-20180910224244-b1866cf76903
 	github.com/major1201/goutils v0.3.0
-	github.com/miekg/dns v1.0.14
+	github.com/miekg/dns v1.1.62
 	github.com/patrickmn/go-cache v2.1.0+incompatible
-	github.com/pkg/errors v0.8.1 // indirect
-	github.com/stretchr/testify v1.2.1
+	github.com/quic-go/quic-go v0.48.2
+	github.com/stretchr/testify v1.9.0
 	github.com/urfave/cli v1.20.0
+	go.uber.org/zap v1.9.1
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/AdguardTeam/golibs v0.20.3 // indirect
+	github.com/aead/chacha20 v0.0.0-20180709150244-8b13a72661da // indirect
+	github.com/aead/poly1305 v0.0.0-20180717145839-3fee0db0b635 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/google/uuid v0.0.0-20161128191214-064e2069ce9c // indirect
+	github.com/kardianos/osext v0.0.0-20190222173326-2bc1f35cddc0 // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
+	github.com/pkg/errors v0.8.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/quic-go/qpack v0.5.1 // indirect
 	go.uber.org/atomic v1.3.2 // indirect
+	go.uber.org/mock v0.4.0 // indirect
 	go.uber.org/multierr v1.1.0 // indirect
-	go.uber.org/zap v1.9.1
-	golang.org/x/crypto v0.0.0-20181030102418-4d3f4d9ffa16 // indirect
-	golang.org/x/net v0.0.0-20181102050134-b7e296877c6e
-	golang.org/x/sync v0.0.0-20190423024810-112230192c58 // indirect
-	golang.org/x/sys v0.0.0-20181107165924-66b7b1311ac8 // indirect
-	golang.org/x/text v0.3.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.18.0 // indirect
+	golang.org/x/sync v0.8.0 // indirect
+	golang.org/x/sys v0.23.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.22.0 // indirect
 	gopkg.in/yaml.v2 v2.2.1 // indirect
 )
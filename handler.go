@@ -1,34 +1,117 @@
 package main
 
 import (
+	"fmt"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
-	"net"
 	"time"
 )
 
-// Handler represents how DNS requests be handled
+// Handler represents how DNS requests be handled, every view has its own handler
 type Handler struct {
-	Upstreams map[string]Upstream
-	Rules     []Rule
+	Name          string
+	Upstreams     map[string]Upstream
+	Rules         []Rule
+	ResponseRules []*ResponseRule
+	// CNAMEInspection makes the CNAME targets in the answers checked against the blocking rules
+	CNAMEInspection bool
+	// RebindProtection checks the answers from the remote upstreams, nil means disabled
+	RebindProtection *RebindProtection
+
+	cache *Cache
+}
+
+// NewHandler creates a handler for the named view with its own cache
+func NewHandler(name string) *Handler {
+	return &Handler{
+		Name: name,
+		Upstreams: map[string]Upstream{
+			"blackhole": &UpstreamBlackHole{UpstreamImpl{name: "blackhole"}},
+			"reject":    &UpstreamReject{UpstreamImpl: UpstreamImpl{name: "reject"}, block: defaultBlockResponse},
+		},
+		Rules: []Rule{},
+		cache: NewCache(),
+	}
+}
+
+// responseRecorder is a dns.ResponseWriter which keeps the answer instead of sending it back to the client
+type responseRecorder struct {
+	dns.ResponseWriter
+	msg *dns.Msg
+}
+
+// WriteMsg records the answer message
+func (rec *responseRecorder) WriteMsg(m *dns.Msg) error {
+	rec.msg = m
+	return nil
+}
+
+// Write records the answer message in wire format
+func (rec *responseRecorder) Write(buf []byte) (int, error) {
+	m := &dns.Msg{}
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	rec.msg = m
+	return len(buf), nil
+}
+
+// Close does nothing, the real writer is closed by the handler
+func (rec *responseRecorder) Close() error {
+	return nil
+}
+
+// maxExchangeDepth limits the nested exchanges caused by the static cname targets and the response rules
+const maxExchangeDepth = 8
+
+// ruleTarget is where a rule sends the request to, an upstream or the static records
+type ruleTarget interface {
+	Upstream() Upstream
+	Static() *StaticAnswer
+}
+
+// listenerHandler passes the DNS requests to the view handler with the listener name
+type listenerHandler struct {
+	handler  *Handler
+	listener string
+}
+
+// ServeDNS handles the DNS requests received from the listener
+func (lh *listenerHandler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	lh.handler.serve(w, r, lh.listener)
 }
 
 // ServeDNS actually handle the DNS requests
 func (handler *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	handler.serve(w, r, "")
+}
+
+func (handler *Handler) serve(w dns.ResponseWriter, r *dns.Msg, listener string) {
 	defer w.Close()
 
-	isMatched := false
 	ruleSearchStartTime := time.Now()
 
 	// log fields
-	fields := make([]zap.Field, 6)
+	fields := make([]zap.Field, 7)
 	fields[0] = zap.String("from", w.RemoteAddr().Network()+"://"+w.RemoteAddr().String())
 	fields[1] = zap.String("to", w.LocalAddr().Network()+"://"+w.LocalAddr().String())
 	fields[3] = zap.String("question", r.Question[0].String())
 	fields[5] = zap.Uint16("id", r.Id)
+	fields[6] = zap.String("view", handler.Name)
 
-	// find in cache
-	if msg, found := GetCache(r.Question[0].String(), r.Id); found {
+	// find in rules
+	q := NewQuery(w, r, listener)
+	rule := handler.route(q)
+	if rule == nil {
+		fields[2] = zap.String("upstream", "nil")
+		fields[4] = zap.Duration("searchtime", time.Since(ruleSearchStartTime))
+		zap.L().Named("query").Info("routing request", fields[:]...)
+		return
+	}
+
+	// find in cache, the answers are cached by the rule as the same name could be routed differently
+	key := cacheKey(r, rule)
+	if msg, found := handler.cache.Get(key, r); found {
 		fields[2] = zap.String("upstream", "cache")
 		fields[4] = zap.Duration("searchtime", time.Since(ruleSearchStartTime))
 		zap.L().Named("query").Info("routing request", fields[:]...)
@@ -37,56 +120,202 @@ func (handler *Handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		return
 	}
 
-	// find in rules
+	if rule.Upstream() == nil {
+		fields[2] = zap.String("upstream", "static")
+	} else {
+		fields[2] = zap.String("upstream", rule.Upstream().Name())
+	}
+	fields[4] = zap.Duration("searchtime", time.Since(ruleSearchStartTime))
+	zap.L().Named("query").Info("routing request", fields[:]...)
+
+	if msg := handler.exchange(rule, w, r, q, key, 0); msg != nil {
+		w.WriteMsg(msg)
+	}
+}
+
+// cacheKey returns the cache key of the request routed by the rule, the rule texts aren't unique
+func cacheKey(req *dns.Msg, rule Rule) string {
+	return fmt.Sprintf("%s %p", req.Question[0].String(), rule)
+}
+
+// route returns the rule for the question, or nil if none matches
+//
+// The precedence of the matching rules is: the first allow rule (an exception with upstream or static records)
+// wins; otherwise the most specific rule wins, and the blocking rules are skipped if any exception without
+// upstream matches; the earlier rule wins if they are equally specific.
+func (handler *Handler) route(q *Query) Rule {
+	var candidates []Rule
+	exempted := false
 	for _, rule := range handler.Rules {
-		if rule.Upstream() == nil && r.Question[0].Qtype != dns.TypeA {
+		if !ruleMatches(rule, q) {
 			continue
 		}
-		if rule.Matches(r.Question[0].Name) {
-			isMatched = true
-			if rule.Upstream() == nil {
-				fields[2] = zap.String("upstream", "static")
-			} else {
-				fields[2] = zap.String("upstream", rule.Upstream().Name())
+		if rule.Exception() {
+			if rule.Upstream() != nil || rule.Static() != nil {
+				return rule
 			}
-			fields[4] = zap.Duration("searchtime", time.Since(ruleSearchStartTime))
-			zap.L().Named("query").Info("routing request", fields[:]...)
-			query(rule, w, r)
-			break
+			exempted = true
+			continue
 		}
+		candidates = append(candidates, rule)
 	}
-	if !isMatched {
-		fields[2] = zap.String("upstream", "nil")
-		fields[4] = zap.Duration("searchtime", time.Since(ruleSearchStartTime))
-		zap.L().Named("query").Info("routing request", fields[:]...)
+
+	var matched Rule
+	for _, rule := range candidates {
+		if exempted && isBlocking(rule) {
+			continue
+		}
+		if matched == nil || rule.Specificity() > matched.Specificity() {
+			matched = rule
+		}
+	}
+	return matched
+}
+
+// isBlocking returns if the rule blocks the requests, which means it's a reject, a black hole or a static rule with
+// the null addresses only, the other static records are local data
+func isBlocking(rule Rule) bool {
+	if rule.Upstream() == nil {
+		return rule.Static().IsNull()
+	}
+	switch rule.Upstream().Type() {
+	case "reject", "blackhole":
+		return true
+	}
+	return false
+}
+
+// isRemote returns if the upstream answers from the network rather than the local data
+func isRemote(upstream Upstream) bool {
+	switch upstream.Type() {
+	case "zone", "hosts", "reject", "blackhole":
+		return false
+	}
+	return true
+}
+
+// inspectCNAME returns the first blocking or static rule matching a CNAME target in the answer, and the matched
+// target, the static sinkhole addresses apply to the CNAME targets though they aren't skipped by the exceptions
+func (handler *Handler) inspectCNAME(msg *dns.Msg, q *Query) (Rule, string) {
+	for _, rr := range msg.Answer {
+		cname, ok := rr.(*dns.CNAME)
+		if !ok {
+			continue
+		}
+		question := dns.Question{Name: cname.Target, Qtype: msg.Question[0].Qtype, Qclass: msg.Question[0].Qclass}
+		if rule := handler.route(q.WithQuestion(question)); rule != nil && (rule.Upstream() == nil || isBlocking(rule)) {
+			return rule, cname.Target
+		}
 	}
+	return nil, ""
 }
 
-func query(r Rule, w dns.ResponseWriter, req *dns.Msg) {
+// matchResponse returns the first response rule matching the answer from the upstream, or nil if none matches, the
+// answers of a request sent again by a response rule are only checked by the rules of the upstream, otherwise a *
+// rule would send it again and again
+func (handler *Handler) matchResponse(upstream Upstream, msg *dns.Msg, rerouted bool) *ResponseRule {
+	for _, rule := range handler.ResponseRules {
+		if rerouted && rule.from == "*" {
+			continue
+		}
+		if rule.Matches(upstream, msg) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// exchange gets the answer of the request from the rule target, nil means nothing should be answered,
+// q describes the request, and the answer is cached by the key
+func (handler *Handler) exchange(rule ruleTarget, w dns.ResponseWriter, req *dns.Msg, q *Query, key string, depth int) *dns.Msg {
 	if len(req.Question) > 1 {
 		zap.L().Debug("question number > 1", zap.Int("length", len(req.Question))) // what
 	}
-	if r.Upstream() != nil {
-		r.Upstream().Query(w, req)
-		return
+
+	if depth >= maxExchangeDepth {
+		zap.L().Named("query").Warn("too many nested exchanges", zap.String("question", req.Question[0].String()))
+		return nil
+	}
+
+	if upstream := rule.Upstream(); upstream != nil {
+		rec := &responseRecorder{ResponseWriter: w}
+		upstream.Query(rec, req)
+		if rec.msg == nil {
+			return nil
+		}
+
+		if handler.CNAMEInspection {
+			if cnameRule, target := handler.inspectCNAME(rec.msg, q); cnameRule != nil {
+				zap.L().Named("query").Info("cname chain element matched",
+					zap.String("question", req.Question[0].String()),
+					zap.Uint16("id", req.Id),
+					zap.String("cname", target),
+					zap.String("rule", cnameRule.Expression()),
+				)
+				return handler.exchange(cnameRule, w, req, q, key, depth+1)
+			}
+		}
+
+		_, rerouted := rule.(*ResponseRule)
+		if responseRule := handler.matchResponse(upstream, rec.msg, rerouted); responseRule != nil {
+			zap.L().Named("query").Info("response rule matched",
+				zap.String("question", req.Question[0].String()),
+				zap.Uint16("id", req.Id),
+				zap.String("rule", responseRule.String()),
+			)
+			if responseRule.Action() == "" {
+				return handler.exchange(responseRule, w, req, q, key, depth+1)
+			}
+			rec.msg = responseRule.Filter(rec.msg)
+		}
+
+		if handler.RebindProtection != nil && isRemote(upstream) {
+			var found bool
+			if rec.msg, found = handler.RebindProtection.Check(rec.msg); found {
+				zap.L().Named("query").Warn("private address in the answer from a remote upstream",
+					zap.String("question", req.Question[0].String()),
+					zap.Uint16("id", req.Id),
+					zap.String("upstream", upstream.Name()),
+					zap.String("mode", handler.RebindProtection.mode),
+				)
+			}
+		}
+
+		// the local answers are cheap, and the block answers depend on the EDNS of the request
+		if isRemote(upstream) {
+			handler.cache.Set(key, rec.msg)
+		}
+		return rec.msg
+	}
+
+	static := rule.Static()
+	msg := static.Reply(req)
+	if !static.Resolve || req.Question[0].Qtype == dns.TypeCNAME {
+		return msg
+	}
+
+	// resolve the cname target through the rules
+	targetReq := &dns.Msg{}
+	targetReq.SetQuestion(static.CNAME(), req.Question[0].Qtype)
+	targetReq.RecursionDesired = req.RecursionDesired
+
+	targetQuery := q.WithQuestion(targetReq.Question[0])
+	targetRule := handler.route(targetQuery)
+	if targetRule == nil {
+		return msg
+	}
+	targetKey := cacheKey(targetReq, targetRule)
+	targetMsg, found := handler.cache.Get(targetKey, targetReq)
+	if !found {
+		zap.L().Named("query").Debug("resolving static cname target",
+			zap.String("question", req.Question[0].String()),
+			zap.String("target", static.CNAME()),
+		)
+		targetMsg = handler.exchange(targetRule, w, targetReq, targetQuery, targetKey, depth+1)
 	}
-	respMsg := &dns.Msg{}
-	respMsg.SetReply(req)
-	switch req.Question[0].Qtype {
-	case dns.TypeA:
-		respMsg.Authoritative = true
-		domain := req.Question[0].Name
-		respMsg.Answer = append(respMsg.Answer, &dns.A{
-			Hdr: dns.RR_Header{
-				Name:   domain,
-				Rrtype: dns.TypeA,
-				Class:  dns.ClassINET,
-				Ttl:    60,
-			},
-			A: net.ParseIP(r.StaticResult()),
-		})
-		w.WriteMsg(respMsg)
-	default:
-		zap.L().Named("query").Error("static type request qtype must be A at this time")
+	if targetMsg != nil {
+		msg.Answer = append(msg.Answer, targetMsg.Answer...)
+		msg.Rcode = targetMsg.Rcode
 	}
+	return msg
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// testResponseWriter keeps the answer written to the client
+type testResponseWriter struct {
+	dns.ResponseWriter
+	client net.IP
+	msg    *dns.Msg
+}
+
+func (w *testResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+
+func (w *testResponseWriter) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: w.client, Port: 10053}
+}
+
+func (w *testResponseWriter) WriteMsg(msg *dns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+func (w *testResponseWriter) Close() error {
+	return nil
+}
+
+// testServe serves the request from the client and returns the answer
+func testServe(handler *Handler, client, name string) *dns.Msg {
+	req := &dns.Msg{}
+	req.SetQuestion(name, dns.TypeA)
+	w := &testResponseWriter{client: net.ParseIP(client)}
+	handler.serve(w, req, "")
+	return w.msg
+}
+
+// cnameUpstream answers all the requests with a CNAME chain
+type cnameUpstream struct {
+	testUpstream
+	chain []string
+}
+
+func (upstream *cnameUpstream) Query(w dns.ResponseWriter, req *dns.Msg) {
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	name := req.Question[0].Name
+	for _, target := range upstream.chain {
+		rr, _ := dns.NewRR(name + " 300 IN CNAME " + target)
+		msg.Answer = append(msg.Answer, rr)
+		name = target
+	}
+	rr, _ := dns.NewRR(name + " 300 IN A " + upstream.address)
+	msg.Answer = append(msg.Answer, rr)
+	w.WriteMsg(msg)
+}
+
+// testExchange routes the request and returns the answer
+func testExchange(handler *Handler, req *dns.Msg) *dns.Msg {
+	q := NewQuery(nil, req, "")
+	rule := handler.route(q)
+	return handler.exchange(rule, nil, req, q, cacheKey(req, rule), 0)
+}
+
+func TestHandler_CNAMEInspection(t *testing.T) {
+	ta := assert.New(t)
+
+	handler := NewHandler("default")
+	handler.Upstreams["public"] = &cnameUpstream{
+		testUpstream: testUpstream{name: "public", address: "1.2.3.4"},
+		chain:        []string{"a.example.net.", "tracker.adxxx.com."},
+	}
+	handler.AddRule("suffix:adxxx.com 0.0.0.0")
+	handler.AddRule("wildcard:* public")
+
+	req := &dns.Msg{}
+	req.SetQuestion("a.example.com.", dns.TypeA)
+
+	msg := testExchange(handler, req)
+	ta.Len(msg.Answer, 3)
+
+	handler.CNAMEInspection = true
+	msg = testExchange(handler, req)
+	ta.Len(msg.Answer, 1)
+	ta.Equal("a.example.com.", msg.Answer[0].Header().Name)
+	ta.Equal("0.0.0.0", msg.Answer[0].(*dns.A).A.String())
+
+	// only the blocking rules are applied
+	handler.Rules = handler.Rules[1:]
+	handler.AddRule("suffix:adxxx.com public")
+	msg = testExchange(handler, req)
+	ta.Len(msg.Answer, 3)
+
+	// the static sinkhole records are applied too
+	handler.Rules = handler.Rules[:1]
+	handler.AddRule("suffix:adxxx.com 10.0.0.99")
+	msg = testExchange(handler, req)
+	ta.Len(msg.Answer, 1)
+	ta.Equal("10.0.0.99", msg.Answer[0].(*dns.A).A.String())
+}
+
+func TestHandler_ServeCache(t *testing.T) {
+	ta := assert.New(t)
+
+	public := &testUpstream{name: "public", address: "1.2.3.4"}
+	handler := NewHandler("default")
+	handler.Upstreams["public"] = public
+	handler.AddRule("wildcard:* public")
+	handler.AddRuleConfig(&RuleConfig{
+		Match:    map[interface{}]interface{}{"all": []interface{}{"suffix:games.example", map[interface{}]interface{}{"client": "10.9.0.0/16"}}},
+		Upstream: "0.0.0.0",
+	}, nil, nil)
+
+	// the answer cached for a client isn't used for the other clients routed differently
+	ta.Equal("1.2.3.4", testServe(handler, "192.168.1.10", "www.games.example.").Answer[0].(*dns.A).A.String())
+	ta.Equal("0.0.0.0", testServe(handler, "10.9.1.10", "www.games.example.").Answer[0].(*dns.A).A.String())
+	ta.Equal("1.2.3.4", testServe(handler, "192.168.1.11", "www.games.example.").Answer[0].(*dns.A).A.String())
+	ta.Equal(1, public.queries)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hosts holds the addresses read from hosts format files and the PTR records generated from them
+type Hosts struct {
+	files []string
+	ttl   uint32
+
+	mu       sync.RWMutex
+	forward  map[string][]net.IP
+	reverse  map[string][]string
+	modTimes map[string]time.Time
+}
+
+// NewHosts reads the hosts files
+func NewHosts(files []string, ttl uint32) (*Hosts, error) {
+	hosts := &Hosts{
+		files: files,
+		ttl:   ttl,
+	}
+	if err := hosts.Reload(); err != nil {
+		return nil, err
+	}
+	return hosts, nil
+}
+
+// Reload reads all the hosts files again, the old records are kept if any of the files fails
+func (hosts *Hosts) Reload() error {
+	forward := map[string][]net.IP{}
+	reverse := map[string][]string{}
+	modTimes := map[string]time.Time{}
+
+	for _, filename := range hosts.files {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		modTimes[filename] = info.ModTime()
+		if err := readHostsFile(filename, forward, reverse); err != nil {
+			return err
+		}
+	}
+
+	hosts.mu.Lock()
+	hosts.forward, hosts.reverse, hosts.modTimes = forward, reverse, modTimes
+	hosts.mu.Unlock()
+	return nil
+}
+
+func readHostsFile(filename string, forward map[string][]net.IP, reverse map[string][]string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		// strip the IPv6 zone, e.g. fe80::1%lo0
+		address := fields[0]
+		if i := strings.Index(address, "%"); i >= 0 {
+			address = address[:i]
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		arpa, err := dns.ReverseAddr(ip.String())
+		if err != nil {
+			continue
+		}
+		for _, name := range fields[1:] {
+			name = strings.ToLower(dns.Fqdn(name))
+			// the same name and address could be on several lines
+			if !slices.ContainsFunc(forward[name], ip.Equal) {
+				forward[name] = append(forward[name], ip)
+			}
+			if !slices.Contains(reverse[arpa], name) {
+				reverse[arpa] = append(reverse[arpa], name)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Watch reloads the hosts files when any of them changes until the context is done, it checks the modification time
+// every interval
+func (hosts *Hosts) Watch(ctx context.Context, interval time.Duration) {
+	logger := zap.L().Named("hosts")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !hosts.changed() {
+			continue
+		}
+		if err := hosts.Reload(); err != nil {
+			logger.Error("reload hosts files failed", zap.Strings("files", hosts.files), zap.Error(err))
+			continue
+		}
+		logger.Info("hosts files reloaded", zap.Strings("files", hosts.files))
+	}
+}
+
+func (hosts *Hosts) changed() bool {
+	hosts.mu.RLock()
+	defer hosts.mu.RUnlock()
+	for _, filename := range hosts.files {
+		info, err := os.Stat(filename)
+		if err != nil || !info.ModTime().Equal(hosts.modTimes[filename]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup answers the A, AAAA and PTR requests, names not in the hosts files get NXDOMAIN
+func (hosts *Hosts) Lookup(req *dns.Msg) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	msg.Authoritative = true
+
+	question := req.Question[0]
+	name := strings.ToLower(question.Name)
+	hdr := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: hosts.ttl}
+
+	hosts.mu.RLock()
+	defer hosts.mu.RUnlock()
+
+	if names, ok := hosts.reverse[name]; ok {
+		if question.Qtype == dns.TypePTR {
+			for _, ptr := range names {
+				msg.Answer = append(msg.Answer, &dns.PTR{Hdr: hdr, Ptr: ptr})
+			}
+		}
+		if len(msg.Answer) == 0 {
+			msg.Ns = append(msg.Ns, syntheticSOA(question.Name, hosts.ttl))
+		}
+		return msg
+	}
+
+	ips, ok := hosts.forward[name]
+	if !ok {
+		msg.Rcode = dns.RcodeNameError
+		msg.Ns = append(msg.Ns, syntheticSOA(question.Name, hosts.ttl))
+		return msg
+	}
+	for _, ip := range ips {
+		switch {
+		case question.Qtype == dns.TypeA && ip.To4() != nil:
+			msg.Answer = append(msg.Answer, &dns.A{Hdr: hdr, A: ip})
+		case question.Qtype == dns.TypeAAAA && ip.To4() == nil:
+			msg.Answer = append(msg.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+		}
+	}
+	if len(msg.Answer) == 0 {
+		msg.Ns = append(msg.Ns, syntheticSOA(question.Name, hosts.ttl))
+	}
+	return msg
+}
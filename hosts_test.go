@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHosts_Lookup(t *testing.T) {
+	ta := assert.New(t)
+
+	filename := filepath.Join(t.TempDir(), "hosts")
+	ta.Nil(os.WriteFile(filename, []byte(`# lab machines
+192.168.1.10  nas.lab nas-alias.lab
+fd00::10      nas.lab   # ipv6
+fe80::1%lo0   link.lab
+192.168.1.10  nas.lab
+bad-address   bad.lab
+`), 0644))
+
+	hosts, err := NewHosts([]string{filename}, 60)
+	ta.Nil(err)
+
+	lookup := func(name string, qtype uint16) *dns.Msg {
+		req := &dns.Msg{}
+		req.SetQuestion(name, qtype)
+		return hosts.Lookup(req)
+	}
+
+	ta.Len(lookup("NAS.lab.", dns.TypeA).Answer, 1)
+	ta.Len(lookup("nas.lab.", dns.TypeAAAA).Answer, 1)
+	ta.Len(lookup("link.lab.", dns.TypeAAAA).Answer, 1)
+	msg := lookup("nas.lab.", dns.TypeMX)
+	ta.Len(msg.Answer, 0)
+	ta.Equal(dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+	msg = lookup("bad.lab.", dns.TypeA)
+	ta.Equal(dns.RcodeNameError, msg.Rcode)
+	ta.Equal(dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+
+	// the duplicate lines are answered once
+	msg = lookup("10.1.168.192.in-addr.arpa.", dns.TypePTR)
+	ta.Len(msg.Answer, 2)
+	ta.Equal("nas.lab.", msg.Answer[0].(*dns.PTR).Ptr)
+
+	msg = lookup("0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", dns.TypePTR)
+	ta.Len(msg.Answer, 1)
+
+	// reload
+	ta.Nil(os.WriteFile(filename, []byte("192.168.1.11 nas.lab\n"), 0644))
+	ta.Nil(hosts.Reload())
+	ta.Equal("192.168.1.11", lookup("nas.lab.", dns.TypeA).Answer[0].(*dns.A).A.String())
+	ta.Equal(dns.RcodeNameError, lookup("nas-alias.lab.", dns.TypeA).Rcode)
+}
+
+func TestHosts_Watch(t *testing.T) {
+	ta := assert.New(t)
+
+	filename := filepath.Join(t.TempDir(), "hosts")
+	ta.Nil(os.WriteFile(filename, []byte("192.168.1.10 nas.lab\n"), 0644))
+	hosts, err := NewHosts([]string{filename}, 60)
+	ta.Nil(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		hosts.Watch(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	ta.Nil(os.WriteFile(filename, []byte("192.168.1.11 nas.lab\n"), 0644))
+	ta.Nil(os.Chtimes(filename, time.Now(), time.Now().Add(time.Minute)))
+	ta.Eventually(func() bool {
+		hosts.mu.RLock()
+		defer hosts.mu.RUnlock()
+		return hosts.forward["nas.lab."][0].String() == "192.168.1.11"
+	}, time.Second, 10*time.Millisecond)
+
+	// the watcher stops with the context
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		ta.Fail("hosts watcher not stopped")
+	}
+}
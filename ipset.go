@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"os"
+	"strings"
+)
+
+// IPSet is a list of IP networks
+type IPSet struct {
+	nets []*net.IPNet
+}
+
+// ParseIPSet parses the entries into an IPSet, every entry is a CIDR, an IP or file:path to a file
+// with one CIDR or IP each line
+func ParseIPSet(entries []string) (*IPSet, error) {
+	set := &IPSet{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "file:") {
+			if err := set.addFile(strings.TrimPrefix(entry, "file:")); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := set.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Add adds a CIDR or an IP to the set
+func (set *IPSet) Add(s string) error {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid ip %q", s)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return err
+	}
+	set.nets = append(set.nets, ipNet)
+	return nil
+}
+
+func (set *IPSet) addFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := set.Add(line); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Len returns the network number of the set
+func (set *IPSet) Len() int {
+	return len(set.nets)
+}
+
+// Contains returns if the ip is in any network of the set
+func (set *IPSet) Contains(ip net.IP) bool {
+	for _, ipNet := range set.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// rrIP returns the address of an A or AAAA record, or nil for the other records
+func rrIP(rr dns.RR) net.IP {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return rr.A
+	case *dns.AAAA:
+		return rr.AAAA
+	}
+	return nil
+}
+
+// answerIPs returns the A and AAAA addresses in the answer section
+func answerIPs(msg *dns.Msg) []net.IP {
+	var ips []net.IP
+	for _, rr := range msg.Answer {
+		if ip := rrIP(rr); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
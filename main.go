@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"github.com/kardianos/service"
 	"github.com/urfave/cli"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"os"
 	"sync"
+	"time"
 )
 
 // Name inspects the project name
@@ -26,7 +28,7 @@ func (p *program) Start(s service.Service) error {
 }
 
 func (p *program) run() {
-	servers := LoadServersFromConfig(p.cliContext.String("config"))
+	servers := LoadServersFromConfig(context.Background(), getConfigPaths(p.cliContext)...)
 	for _, s := range servers {
 		go func(s Server) {
 			if err := s.Serve(); err != nil {
@@ -60,6 +62,13 @@ func initLog(stdout, stderr string, level zapcore.Level) {
 }
 
 func runApp(c *cli.Context) {
+	if c.Bool("check") {
+		// the report is written to stdout
+		initLog("stderr", "stderr", zapcore.DebugLevel)
+		CheckConfig(getConfigPaths(c), os.Stdout, time.Now())
+		return
+	}
+
 	svcConfig := &service.Config{
 		Name:        "dohproxy",
 		DisplayName: "DOH Proxy",
@@ -71,7 +80,10 @@ func runApp(c *cli.Context) {
 			zap.L().Fatal("get current working directory failed")
 		}
 		svcConfig.WorkingDirectory = pwd
-		svcConfig.Arguments = []string{"--from-service", "--config", c.String("config")}
+		svcConfig.Arguments = []string{"--from-service"}
+		for _, path := range getConfigPaths(c) {
+			svcConfig.Arguments = append(svcConfig.Arguments, "--config", path)
+		}
 	}
 
 	prg := &program{
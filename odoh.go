@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/cryptobyte"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// the constants of Oblivious DNS over HTTPS, RFC 9230
+const (
+	odohContentType = "application/oblivious-dns-message"
+	odohConfigPath  = "/.well-known/odohconfigs"
+	odohVersion     = 0x0001
+
+	odohMessageQuery    = 0x01
+	odohMessageResponse = 0x02
+
+	odohLabelKeyID    = "odoh key id"
+	odohLabelQuery    = "odoh query"
+	odohLabelResponse = "odoh response"
+	odohLabelKey      = "odoh key"
+	odohLabelNonce    = "odoh nonce"
+)
+
+// odohConfigRefresh is how often the target config is fetched again
+const odohConfigRefresh = time.Hour
+
+// odohPaddingBlock is the block size the queries are padded to, RFC 8467
+const odohPaddingBlock = 128
+
+// odohConfig is the HPKE config of an ODoH target
+type odohConfig struct {
+	suite     hpke.Suite
+	kdf       hpke.KDF
+	aead      hpke.AEAD
+	publicKey kem.PublicKey
+	keyID     []byte
+}
+
+// parseODoHConfigs returns the first supported config in the ObliviousDoHConfigs of a target
+func parseODoHConfigs(data []byte) (*odohConfig, error) {
+	input := cryptobyte.String(data)
+	var configs cryptobyte.String
+	if !input.ReadUint16LengthPrefixed(&configs) || !input.Empty() {
+		return nil, errors.New("invalid odoh configs")
+	}
+	for !configs.Empty() {
+		var version uint16
+		var contents cryptobyte.String
+		if !configs.ReadUint16(&version) || !configs.ReadUint16LengthPrefixed(&contents) {
+			return nil, errors.New("invalid odoh configs")
+		}
+		if version != odohVersion {
+			continue
+		}
+		if config, err := parseODoHConfigContents(contents); err == nil {
+			return config, nil
+		}
+	}
+	return nil, errors.New("no supported odoh config")
+}
+
+// parseODoHConfigContents decodes an ObliviousDoHConfigContents and derives its key id
+func parseODoHConfigContents(contents []byte) (*odohConfig, error) {
+	input := cryptobyte.String(contents)
+	var kemID, kdfID, aeadID uint16
+	var publicKey cryptobyte.String
+	if !input.ReadUint16(&kemID) || !input.ReadUint16(&kdfID) || !input.ReadUint16(&aeadID) ||
+		!input.ReadUint16LengthPrefixed(&publicKey) || !input.Empty() {
+		return nil, errors.New("invalid odoh config contents")
+	}
+
+	kemAlg, kdf, aead := hpke.KEM(kemID), hpke.KDF(kdfID), hpke.AEAD(aeadID)
+	if !kemAlg.IsValid() || !kdf.IsValid() || !aead.IsValid() {
+		return nil, fmt.Errorf("unsupported odoh cipher suite %#x %#x %#x", kemID, kdfID, aeadID)
+	}
+	pk, err := kemAlg.Scheme().UnmarshalBinaryPublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &odohConfig{
+		suite:     hpke.NewSuite(kemAlg, kdf, aead),
+		kdf:       kdf,
+		aead:      aead,
+		publicKey: pk,
+		keyID:     kdf.Expand(kdf.Extract(contents, nil), []byte(odohLabelKeyID), uint(kdf.ExtractSize())),
+	}, nil
+}
+
+// marshalODoHMessage encodes an ObliviousDoHMessage
+func marshalODoHMessage(messageType uint8, keyID, encrypted []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(messageType)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(keyID) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(encrypted) })
+	return b.BytesOrPanic()
+}
+
+// unmarshalODoHMessage decodes an ObliviousDoHMessage, the key id of a response is the response nonce
+func unmarshalODoHMessage(data []byte) (messageType uint8, keyID, encrypted []byte, err error) {
+	input := cryptobyte.String(data)
+	var keyIDField, encryptedField cryptobyte.String
+	if !input.ReadUint8(&messageType) || !input.ReadUint16LengthPrefixed(&keyIDField) ||
+		!input.ReadUint16LengthPrefixed(&encryptedField) || !input.Empty() {
+		return 0, nil, nil, errors.New("invalid odoh message")
+	}
+	return messageType, keyIDField, encryptedField, nil
+}
+
+// odohAAD returns the associated data of a query or a response
+func odohAAD(messageType uint8, keyID []byte) []byte {
+	var b cryptobyte.Builder
+	b.AddUint8(messageType)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(keyID) })
+	return b.BytesOrPanic()
+}
+
+// marshalODoHPlaintext encodes an ObliviousDoHMessagePlaintext
+func marshalODoHPlaintext(msg []byte, paddingLength int) []byte {
+	var b cryptobyte.Builder
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(msg) })
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(make([]byte, paddingLength)) })
+	return b.BytesOrPanic()
+}
+
+// unmarshalODoHPlaintext decodes an ObliviousDoHMessagePlaintext, the padding must be zeros
+func unmarshalODoHPlaintext(data []byte) ([]byte, error) {
+	input := cryptobyte.String(data)
+	var msg, padding cryptobyte.String
+	if !input.ReadUint16LengthPrefixed(&msg) || !input.ReadUint16LengthPrefixed(&padding) || !input.Empty() {
+		return nil, errors.New("invalid odoh plaintext")
+	}
+	for _, b := range padding {
+		if b != 0 {
+			return nil, errors.New("invalid odoh padding")
+		}
+	}
+	return msg, nil
+}
+
+// odohQueryContext keeps the secret of an encrypted query to decrypt its response
+type odohQueryContext struct {
+	config    *odohConfig
+	plaintext []byte
+	secret    []byte
+}
+
+// sealQuery encrypts the DNS message to the target, and returns the ObliviousDoHMessage of the query
+func (c *odohConfig) sealQuery(msg []byte) (*odohQueryContext, []byte, error) {
+	paddingLength := (odohPaddingBlock - len(msg)%odohPaddingBlock) % odohPaddingBlock
+	plaintext := marshalODoHPlaintext(msg, paddingLength)
+
+	sender, err := c.suite.NewSender(c.publicKey, []byte(odohLabelQuery))
+	if err != nil {
+		return nil, nil, err
+	}
+	enc, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	ct, err := sealer.Seal(plaintext, odohAAD(odohMessageQuery, c.keyID))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	queryContext := &odohQueryContext{
+		config:    c,
+		plaintext: plaintext,
+		secret:    sealer.Export([]byte(odohLabelResponse), c.aead.KeySize()),
+	}
+	return queryContext, marshalODoHMessage(odohMessageQuery, c.keyID, append(enc, ct...)), nil
+}
+
+// responseKey derives the AEAD key and nonce of the response
+func (q *odohQueryContext) responseKey(responseNonce []byte) (key, nonce []byte) {
+	kdf, aead := q.config.kdf, q.config.aead
+	var b cryptobyte.Builder
+	b.AddBytes(q.plaintext)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(responseNonce) })
+	prk := kdf.Extract(q.secret, b.BytesOrPanic())
+	return kdf.Expand(prk, []byte(odohLabelKey), aead.KeySize()), kdf.Expand(prk, []byte(odohLabelNonce), aead.NonceSize())
+}
+
+// openResponse decrypts the ObliviousDoHMessage of the response, and returns the DNS message
+func (q *odohQueryContext) openResponse(data []byte) ([]byte, error) {
+	messageType, responseNonce, encrypted, err := unmarshalODoHMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if messageType != odohMessageResponse {
+		return nil, errors.New("the odoh message is not a response")
+	}
+
+	key, nonce := q.responseKey(responseNonce)
+	aead, err := q.config.aead.New(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce, encrypted, odohAAD(odohMessageResponse, responseNonce))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalODoHPlaintext(plaintext)
+}
+
+// ODoHClient sends Oblivious DNS over HTTPS queries through a relay, the relay sees the client address but not the
+// queries, and the target sees the queries but not the client address
+type ODoHClient struct {
+	target *url.URL
+	relay  *url.URL
+	client *http.Client
+
+	mu        sync.Mutex
+	config    *odohConfig
+	fetchedAt time.Time
+}
+
+// NewODoHClient creates an ODoH client of the target URL like https://odoh.cloudflare-dns.com/dns-query, and the
+// relay URL
+func NewODoHClient(target, relay *url.URL, client *http.Client) *ODoHClient {
+	return &ODoHClient{target: target, relay: relay, client: client}
+}
+
+// targetConfig returns the target config, or fetches it if it's not fetched yet or is too old, fresh tells if the
+// config is just fetched
+func (c *ODoHClient) targetConfig(ctx context.Context) (config *odohConfig, fresh bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config != nil && time.Since(c.fetchedAt) < odohConfigRefresh {
+		return c.config, false, nil
+	}
+
+	configURL := url.URL{Scheme: c.target.Scheme, Host: c.target.Host, Path: odohConfigPath}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, false, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("fetch odoh config failed: %s", httpResp.Status)
+	}
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	config, err = parseODoHConfigs(body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.config, c.fetchedAt = config, time.Now()
+	return config, true, nil
+}
+
+// drop forgets the target config if it's still the current one
+func (c *ODoHClient) drop(config *odohConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.config == config {
+		c.config = nil
+	}
+}
+
+// relayURL returns the relay URL with the target host and path
+func (c *ODoHClient) relayURL() string {
+	u := *c.relay
+	query := u.Query()
+	query.Set("targethost", c.target.Host)
+	query.Set("targetpath", c.target.EscapedPath())
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Exchange encrypts the request to the target, sends it through the relay and returns the decrypted response, the
+// request is retried once with a fetched config if the target has rotated its key
+func (c *ODoHClient) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.client.Timeout)
+	defer cancel()
+
+	msg, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		config, fresh, err := c.targetConfig(ctx)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.exchange(ctx, config, msg)
+		if err == nil {
+			return resp, nil
+		}
+		c.drop(config)
+		if fresh || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+func (c *ODoHClient) exchange(ctx context.Context, config *odohConfig, msg []byte) (*dns.Msg, error) {
+	queryContext, query, err := config.sealQuery(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.relayURL(), bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", odohContentType)
+	httpReq.Header.Set("Accept", odohContentType)
+	httpResp, err := c.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	// the target answers 401 if it doesn't know the key id
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("odoh query failed: %s", httpResp.Status)
+	}
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := queryContext.openResponse(body)
+	if err != nil {
+		return nil, err
+	}
+	resp := &dns.Msg{}
+	if err := resp.Unpack(answer); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/cryptobyte"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// odohTestTarget is an ODoH target answering A records, its key could be rotated
+type odohTestTarget struct {
+	t             *testing.T
+	configFetches int32
+
+	mu         sync.Mutex
+	configs    []byte
+	config     *odohConfig
+	privateKey kem.PrivateKey
+}
+
+// rotate creates a new key pair of the target
+func (target *odohTestTarget) rotate() {
+	kemAlg := hpke.KEM_X25519_HKDF_SHA256
+	publicKey, privateKey, err := kemAlg.Scheme().GenerateKeyPair()
+	if err != nil {
+		target.t.Fatal(err)
+	}
+	publicKeyBytes, _ := publicKey.MarshalBinary()
+
+	var contents cryptobyte.Builder
+	contents.AddUint16(uint16(kemAlg))
+	contents.AddUint16(uint16(hpke.KDF_HKDF_SHA256))
+	contents.AddUint16(uint16(hpke.AEAD_AES128GCM))
+	contents.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(publicKeyBytes) })
+	contentsBytes := contents.BytesOrPanic()
+	config, err := parseODoHConfigContents(contentsBytes)
+	if err != nil {
+		target.t.Fatal(err)
+	}
+
+	var configs cryptobyte.Builder
+	configs.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		// an unknown version is skipped
+		b.AddUint16(0xff03)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes([]byte{1, 2, 3}) })
+		b.AddUint16(odohVersion)
+		b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(contentsBytes) })
+	})
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	target.configs, target.config, target.privateKey = configs.BytesOrPanic(), config, privateKey
+}
+
+func (target *odohTestTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	target.mu.Lock()
+	configs, config, privateKey := target.configs, target.config, target.privateKey
+	target.mu.Unlock()
+
+	if r.URL.Path == odohConfigPath {
+		atomic.AddInt32(&target.configFetches, 1)
+		w.Write(configs)
+		return
+	}
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != odohContentType {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	messageType, keyID, encrypted, err := unmarshalODoHMessage(body)
+	if err != nil || messageType != odohMessageQuery {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if !bytes.Equal(keyID, config.keyID) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	encSize := hpke.KEM_X25519_HKDF_SHA256.Scheme().CiphertextSize()
+	receiver, _ := config.suite.NewReceiver(privateKey, []byte(odohLabelQuery))
+	opener, err := receiver.Setup(encrypted[:encSize])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	plaintext, err := opener.Open(encrypted[encSize:], odohAAD(odohMessageQuery, keyID))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	query, _ := unmarshalODoHPlaintext(plaintext)
+	req := &dns.Msg{}
+	req.Unpack(query)
+
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A 10.0.0.8")
+	msg.Answer = append(msg.Answer, rr)
+	answer, _ := msg.Pack()
+
+	queryContext := &odohQueryContext{
+		config:    config,
+		plaintext: plaintext,
+		secret:    opener.Export([]byte(odohLabelResponse), config.aead.KeySize()),
+	}
+	responseNonce := make([]byte, config.aead.KeySize())
+	rand.Read(responseNonce)
+	key, nonce := queryContext.responseKey(responseNonce)
+	aead, _ := config.aead.New(key)
+	ct := aead.Seal(nil, nonce, marshalODoHPlaintext(answer, 0), odohAAD(odohMessageResponse, responseNonce))
+
+	w.Header().Set("Content-Type", odohContentType)
+	w.Write(marshalODoHMessage(odohMessageResponse, responseNonce, ct))
+}
+
+func TestODoHClient_Exchange(t *testing.T) {
+	ta := assert.New(t)
+
+	target := &odohTestTarget{t: t}
+	target.rotate()
+	targetServer := httptest.NewTLSServer(target)
+	defer targetServer.Close()
+
+	// the relay forwards the queries to the target host and path
+	var relayed int32
+	relayServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&relayed, 1)
+		targetURL := url.URL{Scheme: "https", Host: r.URL.Query().Get("targethost"), Path: r.URL.Query().Get("targetpath")}
+		req, _ := http.NewRequest(http.MethodPost, targetURL.String(), r.Body)
+		req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+		resp, err := targetServer.Client().Do(req)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+	defer relayServer.Close()
+
+	targetURL, _ := url.Parse(targetServer.URL + "/dns-query")
+	relayURL, _ := url.Parse(relayServer.URL + "/proxy?key=value")
+	tlsConfig := newUpstreamTLSConfig("", nil)
+	tlsConfig.RootCAs = targetServer.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+	httpClient, err := newDohClient(relayURL, &dohClientOptions{TLSConfig: tlsConfig})
+	ta.Nil(err)
+	client := NewODoHClient(targetURL, relayURL, httpClient)
+	ta.Contains(client.relayURL(), "key=value")
+
+	query := func() {
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		resp, err := client.Exchange(req)
+		if ta.Nil(err) {
+			ta.Equal(req.Id, resp.Id)
+			ta.Equal("10.0.0.8", resp.Answer[0].(*dns.A).A.String())
+		}
+	}
+
+	query()
+	query()
+	ta.Equal(int32(1), atomic.LoadInt32(&target.configFetches))
+	ta.Equal(int32(2), atomic.LoadInt32(&relayed))
+
+	// the config is fetched again when the target rotates its key
+	target.rotate()
+	query()
+	ta.Equal(int32(2), atomic.LoadInt32(&target.configFetches))
+	ta.Equal(int32(4), atomic.LoadInt32(&relayed))
+
+	_, err = parseODoHConfigs([]byte{0, 4, 0xff, 0x03, 0, 0})
+	ta.NotNil(err)
+}
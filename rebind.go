@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"github.com/miekg/dns"
+)
+
+// the rebinding protection modes
+const (
+	// RebindModeStrip removes the private addresses from the answer
+	RebindModeStrip = "strip"
+	// RebindModeRefuse answers REFUSED if the answer contains any private address
+	RebindModeRefuse = "refuse"
+)
+
+// rebindingNets holds the private, loopback, link-local and CGNAT networks
+var rebindingNets, _ = ParseIPSet([]string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+})
+
+// RebindProtection checks the upstream answers against the DNS rebinding attacks
+type RebindProtection struct {
+	mode string
+	// allow holds the conditions of the names which are allowed to resolve to private addresses
+	allow []Rule
+}
+
+// NewRebindProtection creates the rebinding protection from the config
+func NewRebindProtection(config *RebindConfig) (*RebindProtection, error) {
+	protection := &RebindProtection{mode: RebindModeStrip}
+	switch config.Mode {
+	case "", RebindModeStrip:
+	case RebindModeRefuse:
+		protection.mode = RebindModeRefuse
+	default:
+		return nil, fmt.Errorf("unknown rebinding protection mode %q", config.Mode)
+	}
+
+	for _, condition := range config.Allow {
+		rule, err := ParseCondition(condition)
+		if err != nil {
+			return nil, err
+		}
+		protection.allow = append(protection.allow, rule)
+	}
+	return protection, nil
+}
+
+// allowed returns if the name is in the allowlist
+func (protection *RebindProtection) allowed(name string) bool {
+	for _, rule := range protection.allow {
+		if rule.Matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns the answer without the private addresses, and if any address is found
+func (protection *RebindProtection) Check(msg *dns.Msg) (*dns.Msg, bool) {
+	if protection.allowed(msg.Question[0].Name) {
+		return msg, false
+	}
+
+	found := false
+	for _, ip := range answerIPs(msg) {
+		if rebindingNets.Contains(ip) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return msg, false
+	}
+
+	checked := msg.Copy()
+	if protection.mode == RebindModeRefuse {
+		checked.Rcode = dns.RcodeRefused
+		checked.Answer = nil
+		return checked, true
+	}
+
+	checked.Answer = checked.Answer[:0]
+	for _, rr := range msg.Answer {
+		if ip := rrIP(rr); ip != nil && rebindingNets.Contains(ip) {
+			continue
+		}
+		checked.Answer = append(checked.Answer, dns.Copy(rr))
+	}
+	return checked, true
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestRebindProtection_Check(t *testing.T) {
+	ta := assert.New(t)
+
+	newMsg := func(name string, records ...string) *dns.Msg {
+		msg := &dns.Msg{}
+		msg.SetQuestion(name, dns.TypeA)
+		for _, s := range records {
+			rr, _ := dns.NewRR(s)
+			msg.Answer = append(msg.Answer, rr)
+		}
+		return msg
+	}
+
+	protection, err := NewRebindProtection(&RebindConfig{Allow: []string{"suffix:mycorp.com"}})
+	ta.Nil(err)
+
+	msg, found := protection.Check(newMsg("evil.com.", "evil.com. 60 IN A 1.2.3.4", "evil.com. 60 IN A 192.168.1.1"))
+	ta.True(found)
+	ta.Len(msg.Answer, 1)
+	ta.Equal("1.2.3.4", msg.Answer[0].(*dns.A).A.String())
+
+	_, found = protection.Check(newMsg("cgnat.com.", "cgnat.com. 60 IN A 100.64.0.1"))
+	ta.True(found)
+	_, found = protection.Check(newMsg("v6.com.", "v6.com. 60 IN AAAA fe80::1"))
+	ta.True(found)
+	_, found = protection.Check(newMsg("public.com.", "public.com. 60 IN A 8.8.8.8"))
+	ta.False(found)
+	_, found = protection.Check(newMsg("git.mycorp.com.", "git.mycorp.com. 60 IN A 10.0.0.1"))
+	ta.False(found)
+
+	protection, err = NewRebindProtection(&RebindConfig{Mode: RebindModeRefuse})
+	ta.Nil(err)
+	msg, found = protection.Check(newMsg("evil.com.", "evil.com. 60 IN A 127.0.0.1"))
+	ta.True(found)
+	ta.Equal(dns.RcodeRefused, msg.Rcode)
+	ta.Len(msg.Answer, 0)
+
+	_, err = NewRebindProtection(&RebindConfig{Mode: "drop"})
+	ta.NotNil(err)
+}
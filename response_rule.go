@@ -0,0 +1,142 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+	"strings"
+	"unicode"
+)
+
+// the response rule actions filtering the answer instead of sending the request to another target
+const (
+	// ResponseActionNXDomain answers NXDOMAIN without any records
+	ResponseActionNXDomain = "nxdomain"
+	// ResponseActionNoData answers NOERROR without any records
+	ResponseActionNoData = "nodata"
+	// ResponseActionDrop removes the matching A and AAAA records from the answer
+	ResponseActionDrop = "drop"
+)
+
+// ResponseRule is checked against the answer of an upstream, if it matches the request is sent to the rule
+// upstream again, answered with the rule static records, or the answer is filtered by the rule action
+type ResponseRule struct {
+	RuleImpl
+	// from is the upstream name whose answers the rule is checked against, "*" means any upstream
+	from   string
+	negate bool
+	ipSet  *IPSet
+	action string
+}
+
+// Matches returns if the answer from the upstream matches the response rule
+func (rule *ResponseRule) Matches(upstream Upstream, msg *dns.Msg) bool {
+	if rule.from != "*" && rule.from != upstream.Name() {
+		return false
+	}
+
+	matched := false
+	for _, ip := range answerIPs(msg) {
+		if rule.ipSet.Contains(ip) {
+			matched = true
+			break
+		}
+	}
+	return matched != rule.negate
+}
+
+// Action returns the filter action of the rule, or an empty string if the rule has an upstream or static records
+func (rule *ResponseRule) Action() string {
+	return rule.action
+}
+
+// Filter applies the rule action to the answer
+func (rule *ResponseRule) Filter(msg *dns.Msg) *dns.Msg {
+	filtered := msg.Copy()
+	switch rule.action {
+	case ResponseActionNXDomain:
+		filtered.Rcode = dns.RcodeNameError
+		filtered.Answer = nil
+		filtered.Ns = []dns.RR{syntheticSOA(msg.Question[0].Name, defaultStaticTTL)}
+	case ResponseActionNoData:
+		filtered.Rcode = dns.RcodeSuccess
+		filtered.Answer = nil
+		filtered.Ns = []dns.RR{syntheticSOA(msg.Question[0].Name, defaultStaticTTL)}
+	case ResponseActionDrop:
+		filtered.Answer = filtered.Answer[:0]
+		for _, rr := range msg.Answer {
+			if ip := rrIP(rr); ip != nil && rule.ipSet.Contains(ip) != rule.negate {
+				continue
+			}
+			filtered.Answer = append(filtered.Answer, dns.Copy(rr))
+		}
+	}
+	return filtered
+}
+
+// String returns the rule in config format
+func (rule *ResponseRule) String() string {
+	condition := "ip:" + rule.expression
+	if rule.negate {
+		condition = "!" + condition
+	}
+	return rule.from + " " + condition
+}
+
+// AddResponseRule converts a response rule in raw string into ResponseRule and appends it the handler response rules
+func (handler *Handler) AddResponseRule(text string, ipSets map[string]*IPSet) {
+	logger := zap.L().Named("config")
+
+	parts := splitOutsideQuotes(text, unicode.IsSpace)
+	if len(parts) < 3 {
+		logger.Fatal("response rule fields must be at least 3 parts", zap.Strings("fields", parts))
+	}
+
+	rule := &ResponseRule{from: parts[0]}
+	if _, ok := handler.Upstreams[rule.from]; !ok && rule.from != "*" {
+		logger.Fatal("unknown upstream", zap.String("name", rule.from))
+	}
+
+	// condition
+	condition := parts[1]
+	if strings.HasPrefix(condition, "!") {
+		rule.negate = true
+		condition = condition[1:]
+	}
+	if !strings.HasPrefix(condition, "ip:") {
+		logger.Fatal("unknown response rule condition", zap.String("condition", parts[1]))
+	}
+	rule.expression = strings.TrimPrefix(condition, "ip:")
+	if ipSet, ok := ipSets[rule.expression]; ok {
+		rule.ipSet = ipSet
+	} else {
+		ipSet, err := ParseIPSet(strings.Split(rule.expression, ","))
+		if err != nil {
+			logger.Fatal("unknown ip set or invalid ip", zap.String("condition", parts[1]), zap.Error(err))
+		}
+		rule.ipSet = ipSet
+	}
+
+	// upstream
+	if upstream, ok := handler.Upstreams[parts[2]]; ok {
+		if len(parts) > 3 {
+			logger.Fatal("rule options are only allowed with static records", zap.Strings("fields", parts))
+		}
+		if parts[2] == rule.from {
+			logger.Fatal("response rule can't send the request to the same upstream", zap.String("upstream", parts[2]))
+		}
+		rule.SetUpstream(upstream)
+	} else if parts[2] == ResponseActionNXDomain || parts[2] == ResponseActionNoData || parts[2] == ResponseActionDrop {
+		if len(parts) > 3 {
+			logger.Fatal("rule options are only allowed with static records", zap.Strings("fields", parts))
+		}
+		rule.action = parts[2]
+	} else {
+		static, err := ParseStaticAnswer(parts[2], parts[3:])
+		if err != nil {
+			logger.Fatal("unknown upstream or invalid static records", zap.String("target", parts[2]), zap.Error(err))
+		}
+		rule.SetStatic(static)
+	}
+
+	handler.ResponseRules = append(handler.ResponseRules, rule)
+}
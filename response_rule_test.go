@@ -0,0 +1,141 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+)
+
+// testUpstream answers all the A requests with the address
+type testUpstream struct {
+	name    string
+	address string
+	queries int
+}
+
+func (upstream *testUpstream) Type() string {
+	return "test"
+}
+
+func (upstream *testUpstream) Name() string {
+	return upstream.name
+}
+
+func (upstream *testUpstream) Query(w dns.ResponseWriter, req *dns.Msg) {
+	upstream.queries++
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	rr, _ := dns.NewRR(req.Question[0].Name + " 300 IN A " + upstream.address)
+	msg.Answer = append(msg.Answer, rr)
+	w.WriteMsg(msg)
+}
+
+func TestIPSet_Contains(t *testing.T) {
+	ta := assert.New(t)
+	set, err := ParseIPSet([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"})
+	ta.Nil(err)
+	ta.Equal(3, set.Len())
+	ta.True(set.Contains(net.ParseIP("10.1.2.3")))
+	ta.True(set.Contains(net.ParseIP("192.168.1.1")))
+	ta.False(set.Contains(net.ParseIP("192.168.1.2")))
+	ta.True(set.Contains(net.ParseIP("fd00::1")))
+
+	_, err = ParseIPSet([]string{"10.0.0.0/33"})
+	ta.NotNil(err)
+}
+
+func TestHandler_ResponseRules(t *testing.T) {
+	ta := assert.New(t)
+
+	domestic := &testUpstream{name: "domestic", address: "8.8.8.8"}
+	poisoned := &testUpstream{name: "poisoned", address: "243.185.187.39"}
+	doh := &testUpstream{name: "doh", address: "1.1.1.1"}
+
+	handler := NewHandler("default")
+	handler.Upstreams["domestic"] = domestic
+	handler.Upstreams["poisoned"] = poisoned
+	handler.Upstreams["doh"] = doh
+	ipSets := map[string]*IPSet{}
+	ipSets["china"], _ = ParseIPSet([]string{"1.0.1.0/24", "114.114.114.0/24"})
+	handler.AddRule("suffix:foreign.com domestic")
+	handler.AddRule("suffix:poisoned.com poisoned")
+	handler.AddResponseRule("domestic !ip:china doh", ipSets)
+	handler.AddResponseRule("* ip:243.185.187.39 0.0.0.0", ipSets)
+
+	req := &dns.Msg{}
+	req.SetQuestion("www.foreign.com.", dns.TypeA)
+	msg := testExchange(handler, req)
+	ta.Equal("1.1.1.1", msg.Answer[0].(*dns.A).A.String())
+	ta.Equal(1, domestic.queries)
+	ta.Equal(1, doh.queries)
+
+	// the rewritten answer is cached instead of the original one
+	cached, found := handler.cache.Get(cacheKey(req, handler.route(NewQuery(nil, req, ""))), req)
+	ta.True(found)
+	ta.Equal("1.1.1.1", cached.Answer[0].(*dns.A).A.String())
+
+	req.SetQuestion("www.poisoned.com.", dns.TypeA)
+	msg = testExchange(handler, req)
+	ta.Equal("0.0.0.0", msg.Answer[0].(*dns.A).A.String())
+}
+
+func TestResponseRule_Filter(t *testing.T) {
+	ta := assert.New(t)
+
+	req := &dns.Msg{}
+	req.SetQuestion("tracker.example.com.", dns.TypeA)
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	for _, s := range []string{
+		"tracker.example.com. 300 IN CNAME ads.adxxx.com.",
+		"ads.adxxx.com. 300 IN A 10.6.6.6",
+		"ads.adxxx.com. 300 IN A 1.2.3.4",
+	} {
+		rr, _ := dns.NewRR(s)
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	handler := NewHandler("default")
+	handler.AddResponseRule("* ip:10.6.6.0/24 drop", nil)
+	handler.AddResponseRule("* ip:10.6.6.0/24 nxdomain", nil)
+	handler.AddResponseRule("* !ip:10.6.6.0/24 nodata", nil)
+
+	filtered := handler.ResponseRules[0].Filter(msg)
+	ta.Len(filtered.Answer, 2)
+	ta.Equal("1.2.3.4", filtered.Answer[1].(*dns.A).A.String())
+	ta.Len(msg.Answer, 3)
+
+	filtered = handler.ResponseRules[1].Filter(msg)
+	ta.Equal(dns.RcodeNameError, filtered.Rcode)
+	ta.Len(filtered.Answer, 0)
+
+	ta.False(handler.ResponseRules[2].Matches(&testUpstream{name: "any"}, msg))
+	filtered = handler.ResponseRules[2].Filter(msg)
+	ta.Equal(dns.RcodeSuccess, filtered.Rcode)
+	ta.Len(filtered.Answer, 0)
+}
+
+func TestHandler_ResponseRulesAny(t *testing.T) {
+	ta := assert.New(t)
+
+	domestic := &testUpstream{name: "domestic", address: "8.8.8.8"}
+	doh := &testUpstream{name: "doh", address: "1.1.1.1"}
+
+	handler := NewHandler("default")
+	handler.Upstreams["domestic"] = domestic
+	handler.Upstreams["doh"] = doh
+	ipSets := map[string]*IPSet{}
+	ipSets["china"], _ = ParseIPSet([]string{"1.0.1.0/24", "114.114.114.0/24"})
+	handler.AddRule("suffix:foreign.com domestic")
+	handler.AddResponseRule("* !ip:china doh", ipSets)
+
+	// the answer of doh doesn't match either, but it isn't sent to doh again
+	req := &dns.Msg{}
+	req.SetQuestion("www.foreign.com.", dns.TypeA)
+	msg := testExchange(handler, req)
+	ta.NotNil(msg)
+	ta.Equal("1.1.1.1", msg.Answer[0].(*dns.A).A.String())
+	ta.Equal(1, domestic.queries)
+	ta.Equal(1, doh.queries)
+}
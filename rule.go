@@ -1,15 +1,24 @@
 package main
 
 import (
+	"fmt"
 	"github.com/major1201/goutils"
+	"github.com/miekg/dns"
 	"go.uber.org/zap"
 	"regexp"
 	"strings"
+	"time"
+	"unicode"
 )
 
 // Rule describes the DNS rule interface
 type Rule interface {
 	Matches(address string) bool
+	// Specificity tells how specific the rule is, the most specific one wins if several rules match
+	Specificity() int
+
+	Exception() bool
+	SetException(o bool)
 
 	Expression() string
 	SetExpression(o string)
@@ -17,15 +26,26 @@ type Rule interface {
 	Upstream() Upstream
 	SetUpstream(o Upstream)
 
-	StaticResult() string
-	SetStaticResult(o string)
+	Static() *StaticAnswer
+	SetStatic(o *StaticAnswer)
+
+	// Schedule tells when the rule is active, nil means always
+	Schedule() *Schedule
+	SetSchedule(o *Schedule)
+
+	// Text is how the rule is written in the config file
+	Text() string
+	SetText(o string)
 }
 
 // RuleImpl is the implement of Rule interface
 type RuleImpl struct {
-	expression   string
-	upstream     Upstream
-	staticResult string
+	expression string
+	upstream   Upstream
+	static     *StaticAnswer
+	exception  bool
+	schedule   *Schedule
+	text       string
 }
 
 // Expression returns the expression of a rule
@@ -38,6 +58,16 @@ func (r *RuleImpl) SetExpression(o string) {
 	r.expression = o
 }
 
+// Exception returns if the rule is an exception or allow rule
+func (r *RuleImpl) Exception() bool {
+	return r.exception
+}
+
+// SetException set the rule exception attribute
+func (r *RuleImpl) SetException(o bool) {
+	r.exception = o
+}
+
 // Upstream returns the upstream of a rule
 func (r *RuleImpl) Upstream() Upstream {
 	return r.upstream
@@ -48,14 +78,34 @@ func (r *RuleImpl) SetUpstream(o Upstream) {
 	r.upstream = o
 }
 
-// StaticResult returns the static result of a rule
-func (r *RuleImpl) StaticResult() string {
-	return r.staticResult
+// Static returns the static answer of a rule
+func (r *RuleImpl) Static() *StaticAnswer {
+	return r.static
+}
+
+// SetStatic set the rule static answer attribute
+func (r *RuleImpl) SetStatic(o *StaticAnswer) {
+	r.static = o
 }
 
-// SetStaticResult set the rule static result attribute
-func (r *RuleImpl) SetStaticResult(o string) {
-	r.staticResult = o
+// Schedule returns the schedule of a rule
+func (r *RuleImpl) Schedule() *Schedule {
+	return r.schedule
+}
+
+// SetSchedule set the rule schedule attribute
+func (r *RuleImpl) SetSchedule(o *Schedule) {
+	r.schedule = o
+}
+
+// Text returns the text of a rule
+func (r *RuleImpl) Text() string {
+	return r.text
+}
+
+// SetText set the rule text attribute
+func (r *RuleImpl) SetText(o string) {
+	r.text = o
 }
 
 // FQDNRule matches a domain by FQDN
@@ -89,6 +139,12 @@ type RegexRule struct {
 	regex *regexp.Regexp
 }
 
+// CompositeRule matches a query by a composite condition
+type CompositeRule struct {
+	RuleImpl
+	condition Condition
+}
+
 // Matches returns if the address matches the FQDN rule
 func (rule *FQDNRule) Matches(address string) bool {
 	return strings.TrimSuffix(rule.expression, ".") == strings.TrimSuffix(strings.ToLower(address), ".")
@@ -119,18 +175,11 @@ func (rule *RegexRule) Matches(address string) bool {
 	return rule.regex.MatchString(strings.ToLower(address))
 }
 
-// AddRule converts a rule in raw string into Rule and appends it the handler rules
-func (handler *Handler) AddRule(text string) {
-	logger := zap.L().Named("config")
-
-	parts := strings.Fields(text)
-	if len(parts) != 2 {
-		logger.Fatal("rule fields must be 2 parts", zap.Strings("fields", parts))
-	}
-
-	condition := strings.Split(parts[0], ":")
+// ParseCondition converts a condition like suffix:google.com into a Rule without upstream
+func ParseCondition(text string) (Rule, error) {
+	condition := strings.Split(text, ":")
 	if len(condition) != 2 {
-		logger.Fatal("rule condition must be 2 parts", zap.Strings("condition", condition))
+		return nil, fmt.Errorf("rule condition must be 2 parts, got %q", text)
 	}
 
 	conditionType := condition[0]
@@ -150,24 +199,186 @@ func (handler *Handler) AddRule(text string) {
 	case "regex":
 		regex, err := regexp.Compile(condition[1])
 		if err != nil {
-			logger.Fatal("regex compile failed", zap.String("exp", condition[1]))
+			return nil, fmt.Errorf("regex compile failed: %v", err)
 		}
 		rule = &RegexRule{regex: regex}
 	default:
-		logger.Fatal("unknown condition type", zap.String("type", conditionType))
+		return nil, fmt.Errorf("unknown condition type %q", conditionType)
 	}
 	rule.SetExpression(strings.ToLower(condition[1]))
+	return rule, nil
+}
 
-	// upstream
-	if upstream, ok := handler.Upstreams[parts[1]]; ok {
-		rule.SetUpstream(upstream)
+// fqdnSpecificity is the specificity of the fqdn rules, it's higher than any other rules
+const fqdnSpecificity = 1000
+
+// countLabels returns the number of the labels in the expression, the labels containing wildcards are not counted
+func countLabels(expression string) int {
+	count := 0
+	for _, label := range strings.Split(expression, ".") {
+		if label != "" && !strings.ContainsAny(label, "*?") {
+			count++
+		}
+	}
+	return count
+}
+
+// Specificity returns the specificity of the FQDN rule
+func (rule *FQDNRule) Specificity() int {
+	return fqdnSpecificity
+}
+
+// Specificity returns the specificity of the prefix rule, which is the label number
+func (rule *PrefixRule) Specificity() int {
+	return countLabels(rule.expression)
+}
+
+// Specificity returns the specificity of the suffix rule, which is the label number
+func (rule *SuffixRule) Specificity() int {
+	return countLabels(rule.expression)
+}
+
+// Specificity returns the specificity of the keyword rule, which is always 0
+func (rule *KeywordRule) Specificity() int {
+	return 0
+}
+
+// Specificity returns the specificity of the wildcard rule, which is the label number without wildcards
+func (rule *WildcardRule) Specificity() int {
+	return countLabels(rule.expression)
+}
+
+// Specificity returns the specificity of the regex rule, which is always 0
+func (rule *RegexRule) Specificity() int {
+	return 0
+}
+
+// Matches returns if the address matches the composite rule, the query attributes other than the name are unknown
+func (rule *CompositeRule) Matches(address string) bool {
+	return rule.condition.Test(&Query{Question: dns.Question{Name: address}})
+}
+
+// MatchesQuery returns if the query matches the composite rule
+func (rule *CompositeRule) MatchesQuery(q *Query) bool {
+	return rule.condition.Test(q)
+}
+
+// Specificity returns the specificity of the composite condition
+func (rule *CompositeRule) Specificity() int {
+	return rule.condition.Specificity()
+}
+
+// queryMatcher is implemented by the rules matching more than the query name
+type queryMatcher interface {
+	MatchesQuery(q *Query) bool
+}
+
+// ruleActive returns if the rule is in its schedule at the time
+func ruleActive(rule Rule, t time.Time) bool {
+	return rule.Schedule() == nil || rule.Schedule().Active(t)
+}
+
+// ruleMatches returns if the query matches the rule, the rules out of their schedules never match
+func ruleMatches(rule Rule, q *Query) bool {
+	if !ruleActive(rule, q.Time) {
+		return false
+	}
+	if matcher, ok := rule.(queryMatcher); ok {
+		return matcher.MatchesQuery(q)
+	}
+	return rule.Matches(q.Name)
+}
+
+// AddRule converts a rule in raw string into Rule and appends it the handler rules
+func (handler *Handler) AddRule(text string) {
+	handler.Rules = append(handler.Rules, handler.parseRule(splitOutsideQuotes(text, unicode.IsSpace)))
+}
+
+// parseRule converts the fields of a rule string into Rule
+func (handler *Handler) parseRule(parts []string) Rule {
+	logger := zap.L().Named("config")
+
+	exception := len(parts) > 0 && strings.HasPrefix(parts[0], "@@")
+	if len(parts) < 2 && !exception {
+		logger.Fatal("rule fields must be at least 2 parts", zap.Strings("fields", parts))
+	}
+
+	rule, err := ParseCondition(strings.TrimPrefix(parts[0], "@@"))
+	if err != nil {
+		logger.Fatal("rule condition parse error", zap.String("condition", parts[0]), zap.Error(err))
+	}
+	rule.SetException(exception)
+	rule.SetText(strings.Join(parts, " "))
+
+	// upstream, an exception without upstream only disables the blocking rules
+	if len(parts) > 1 {
+		handler.setTarget(rule, parts[1], parts[2:])
+	}
+
+	return rule
+}
+
+// AddRuleConfig converts a rule in the config file into Rule and appends it the handler rules
+func (handler *Handler) AddRuleConfig(config *RuleConfig, ipSets map[string]*IPSet, schedules map[string]*Schedule) {
+	logger := zap.L().Named("config")
+
+	var rule Rule
+	scheduleName := config.Schedule
+	if config.Text != "" {
+		// the schedule=name option works with all the rules, the other options belong to the target
+		var parts []string
+		for _, part := range splitOutsideQuotes(config.Text, unicode.IsSpace) {
+			if strings.HasPrefix(part, "schedule=") {
+				scheduleName = strings.TrimPrefix(part, "schedule=")
+				continue
+			}
+			parts = append(parts, part)
+		}
+		rule = handler.parseRule(parts)
+		rule.SetText(config.Text)
 	} else {
-		if goutils.IsIPv4(parts[1]) {
-			rule.SetStaticResult(parts[1])
-		} else {
-			logger.Fatal("unknown upstream", zap.String("name", parts[1]))
+		condition, err := ParseConditionNode(config.Match, ipSets)
+		if err != nil {
+			logger.Fatal("rule match parse error", zap.Error(err))
+		}
+		rule = &CompositeRule{condition: condition}
+		rule.SetExpression("composite")
+		rule.SetException(config.Exception)
+		rule.SetText("match:" + formatConditionNode(config.Match))
+
+		if config.Upstream != "" {
+			handler.setTarget(rule, config.Upstream, config.Options)
+		} else if !config.Exception {
+			logger.Fatal("rule upstream is required unless it's an exception")
+		}
+	}
+
+	if scheduleName != "" {
+		schedule, ok := schedules[scheduleName]
+		if !ok {
+			logger.Fatal("unknown schedule", zap.String("schedule", scheduleName), zap.String("rule", rule.Text()))
 		}
+		rule.SetSchedule(schedule)
 	}
 
 	handler.Rules = append(handler.Rules, rule)
 }
+
+// setTarget sets the upstream or the static records of the rule
+func (handler *Handler) setTarget(rule Rule, target string, options []string) {
+	logger := zap.L().Named("config")
+
+	if upstream, ok := handler.Upstreams[target]; ok {
+		if len(options) > 0 {
+			logger.Fatal("rule options are only allowed with static records", zap.String("target", target), zap.Strings("options", options))
+		}
+		rule.SetUpstream(upstream)
+		return
+	}
+
+	static, err := ParseStaticAnswer(target, options)
+	if err != nil {
+		logger.Fatal("unknown upstream or invalid static records", zap.String("target", target), zap.Error(err))
+	}
+	rule.SetStatic(static)
+}
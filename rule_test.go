@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -55,3 +56,74 @@ func TestSuffixRule_Matches(t *testing.T) {
 	ta.True(rule.Matches("google.com"))
 	ta.False(rule.Matches("www.higoogle.com"))
 }
+
+func TestHandler_Route(t *testing.T) {
+	ta := assert.New(t)
+
+	handler := NewHandler("default")
+	handler.Upstreams["public"] = &testUpstream{name: "public"}
+	handler.Upstreams["corp"] = &testUpstream{name: "corp"}
+	handler.AddRule("wildcard:* public")
+	handler.AddRule("suffix:adxxx.com reject")
+	handler.AddRule("suffix:google.com corp")
+	handler.AddRule("fqdn:www.google.com public")
+	handler.AddRule("@@suffix:cdn.adxxx.com")
+	handler.AddRule("@@fqdn:mail.google.com corp")
+	handler.AddRule("suffix:mail.google.com reject")
+
+	route := func(name string) string {
+		rule := handler.route(&Query{Question: dns.Question{Name: name, Qtype: dns.TypeA}})
+		if rule == nil {
+			return ""
+		}
+		return rule.Upstream().Name()
+	}
+
+	// most specific
+	ta.Equal("public", route("www.example.com."))
+	ta.Equal("corp", route("maps.google.com."))
+	ta.Equal("public", route("www.google.com."))
+	ta.Equal("reject", route("ads.adxxx.com."))
+
+	// exceptions
+	ta.Equal("public", route("img.cdn.adxxx.com."))
+	ta.Equal("corp", route("mail.google.com."))
+	ta.Equal("reject", route("x.mail.google.com."))
+}
+
+func TestHandler_RouteExceptionStatic(t *testing.T) {
+	ta := assert.New(t)
+
+	handler := NewHandler("default")
+	handler.Upstreams["public"] = &testUpstream{name: "public"}
+	handler.AddRule("wildcard:* public")
+	handler.AddRule("suffix:example.lan 192.168.1.10")
+	handler.AddRule("suffix:ads.example.com 0.0.0.0,::")
+	handler.AddRule("@@suffix:example.lan")
+	handler.AddRule("@@suffix:ads.example.com")
+
+	route := func(name string) Rule {
+		return handler.route(&Query{Question: dns.Question{Name: name, Qtype: dns.TypeA}})
+	}
+
+	// the local records are kept, only the null answers are skipped
+	ta.Nil(route("nas.example.lan.").Upstream())
+	ta.Equal("public", route("x.ads.example.com.").Upstream().Name())
+}
+
+func TestRule_Specificity(t *testing.T) {
+	ta := assert.New(t)
+	for condition, specificity := range map[string]int{
+		"fqdn:www.google.com":   fqdnSpecificity,
+		"suffix:.google.com":    2,
+		"prefix:www.google.":    2,
+		"wildcard:*.google.com": 2,
+		"wildcard:*":            0,
+		"keyword:google":        0,
+		"regex:^www":            0,
+	} {
+		rule, err := ParseCondition(condition)
+		ta.Nil(err)
+		ta.Equal(specificity, rule.Specificity(), condition)
+	}
+}
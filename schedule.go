@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	// the time zone database is embedded, the minimal container images don't have one
+	_ "time/tzdata"
+)
+
+// weekdays maps the day names in the schedules to the weekdays
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ScheduleConfig describes a schedule in the config file
+type ScheduleConfig struct {
+	Days     []string
+	Times    []string
+	Timezone string
+}
+
+// Schedule tells when a rule is active
+type Schedule struct {
+	name     string
+	days     [7]bool
+	windows  []*timeCondition
+	location *time.Location
+}
+
+// NewSchedule creates a schedule, no days means every day, no times means all day long and the default time zone is
+// the local one
+func NewSchedule(name string, config *ScheduleConfig) (*Schedule, error) {
+	schedule := &Schedule{name: name, location: time.Local}
+	if config == nil {
+		config = &ScheduleConfig{}
+	}
+
+	if len(config.Days) == 0 {
+		for i := range schedule.days {
+			schedule.days[i] = true
+		}
+	}
+	for _, days := range config.Days {
+		if err := schedule.addDays(strings.ToLower(strings.TrimSpace(days))); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range config.Times {
+		window, err := parseTimeWindow(s)
+		if err != nil {
+			return nil, err
+		}
+		schedule.windows = append(schedule.windows, window)
+	}
+
+	if config.Timezone != "" {
+		location, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("unknown time zone %q", config.Timezone)
+		}
+		schedule.location = location
+	}
+
+	return schedule, nil
+}
+
+// addDays adds a day like mon or a day range like mon-fri, the range could cross the weekend, e.g. fri-mon
+func (schedule *Schedule) addDays(days string) error {
+	bounds := strings.Split(days, "-")
+	if len(bounds) > 2 {
+		return fmt.Errorf("invalid days %q", days)
+	}
+	var weekdayBounds [2]time.Weekday
+	for i, bound := range bounds {
+		weekday, ok := weekdays[bound]
+		if !ok {
+			return fmt.Errorf("unknown day %q, must be one of sun, mon, tue, wed, thu, fri, sat", bound)
+		}
+		weekdayBounds[i] = weekday
+	}
+	if len(bounds) == 1 {
+		weekdayBounds[1] = weekdayBounds[0]
+	}
+
+	for day := weekdayBounds[0]; ; day = (day + 1) % 7 {
+		schedule.days[day] = true
+		if day == weekdayBounds[1] {
+			return nil
+		}
+	}
+}
+
+// Name returns the schedule name
+func (schedule *Schedule) Name() string {
+	return schedule.name
+}
+
+// Active returns if the time is in the schedule, the part of a window after the midnight belongs to the day the window
+// starts, e.g. friday 06:00 is in "thu 21:00-07:00"
+func (schedule *Schedule) Active(t time.Time) bool {
+	t = t.In(schedule.location)
+	day := t.Weekday()
+	if len(schedule.windows) == 0 {
+		return schedule.days[day]
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, window := range schedule.windows {
+		switch {
+		case window.start <= window.end:
+			if schedule.days[day] && minute >= window.start && minute < window.end {
+				return true
+			}
+		case minute >= window.start:
+			if schedule.days[day] {
+				return true
+			}
+		case minute < window.end:
+			if schedule.days[(day+6)%7] {
+				return true
+			}
+		}
+	}
+	return false
+}
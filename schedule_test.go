@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSchedule_Active(t *testing.T) {
+	ta := assert.New(t)
+
+	// school nights, sunday to thursday
+	schedule, err := NewSchedule("school-nights", &ScheduleConfig{
+		Days:     []string{"sun-thu"},
+		Times:    []string{"20:00-07:00"},
+		Timezone: "Europe/Berlin",
+	})
+	ta.Nil(err)
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	at := func(day, hour int) time.Time {
+		// 2020-01-02 is a thursday
+		return time.Date(2020, 1, day, hour, 30, 0, 0, berlin)
+	}
+	ta.True(schedule.Active(at(2, 21)))
+	ta.True(schedule.Active(at(3, 6)))
+	ta.False(schedule.Active(at(3, 7)))
+	ta.False(schedule.Active(at(3, 21)))
+	ta.False(schedule.Active(at(4, 6)))
+	ta.True(schedule.Active(at(5, 20)))
+	ta.True(schedule.Active(at(6, 0)))
+
+	// the time zone of the schedule is used
+	ta.True(schedule.Active(at(2, 21).UTC()))
+
+	schedule, err = NewSchedule("weekend", &ScheduleConfig{Days: []string{"sat", "Sun"}})
+	ta.Nil(err)
+	ta.False(schedule.Active(at(3, 12)))
+	ta.True(schedule.Active(at(4, 12)))
+	ta.True(schedule.Active(at(5, 12)))
+
+	schedule, err = NewSchedule("lunch", &ScheduleConfig{Times: []string{"12:00-13:00", "18:00-19:00"}})
+	ta.Nil(err)
+	ta.True(schedule.Active(time.Date(2020, 1, 2, 12, 30, 0, 0, time.Local)))
+	ta.True(schedule.Active(time.Date(2020, 1, 4, 18, 0, 0, 0, time.Local)))
+	ta.False(schedule.Active(time.Date(2020, 1, 4, 13, 0, 0, 0, time.Local)))
+
+	for _, config := range []*ScheduleConfig{
+		{Days: []string{"monday"}},
+		{Days: []string{"mon-tue-wed"}},
+		{Times: []string{"20:00"}},
+		{Timezone: "Mars/Olympus"},
+	} {
+		_, err := NewSchedule("bad", config)
+		ta.NotNil(err, "%v", config)
+	}
+}
+
+func TestHandler_AddRuleConfigSchedule(t *testing.T) {
+	ta := assert.New(t)
+
+	schedule, err := NewSchedule("school-nights", &ScheduleConfig{Days: []string{"sun-thu"}, Times: []string{"20:00-07:00"}})
+	ta.Nil(err)
+	schedules := map[string]*Schedule{"school-nights": schedule}
+
+	handler := NewHandler("default")
+	handler.Upstreams["public"] = &testUpstream{name: "public"}
+	handler.AddRuleConfig(&RuleConfig{Text: "suffix:games.example reject schedule=school-nights"}, nil, schedules)
+	handler.AddRuleConfig(&RuleConfig{
+		Match:    map[interface{}]interface{}{"client": "10.0.1.0/24"},
+		Upstream: "reject",
+		Schedule: "school-nights",
+	}, nil, schedules)
+	handler.AddRuleConfig(&RuleConfig{Text: "wildcard:* public"}, nil, schedules)
+	ta.Equal("suffix:games.example reject schedule=school-nights", handler.Rules[0].Text())
+	ta.Equal("match:client:10.0.1.0/24", handler.Rules[1].Text())
+
+	route := func(name, client string, day, hour int) string {
+		return handler.route(&Query{
+			Question: dns.Question{Name: name, Qtype: dns.TypeA},
+			Client:   net.ParseIP(client),
+			Time:     time.Date(2020, 1, day, hour, 0, 0, 0, time.Local),
+		}).Upstream().Name()
+	}
+	ta.Equal("reject", route("www.games.example.", "192.168.1.10", 2, 21))
+	ta.Equal("public", route("www.games.example.", "192.168.1.10", 3, 21))
+	ta.Equal("reject", route("www.google.com.", "10.0.1.10", 2, 22))
+	ta.Equal("public", route("www.google.com.", "10.0.1.10", 2, 12))
+}
+
+func TestHandler_ServeSchedule(t *testing.T) {
+	ta := assert.New(t)
+
+	day := func(offset int) string {
+		return time.Now().AddDate(0, 0, offset).Weekday().String()[:3]
+	}
+	later, err := NewSchedule("later", &ScheduleConfig{Days: []string{day(2)}})
+	ta.Nil(err)
+	today, err := NewSchedule("today", &ScheduleConfig{Days: []string{day(-1), day(0), day(1)}})
+	ta.Nil(err)
+
+	public := &testUpstream{name: "public", address: "1.2.3.4"}
+	handler := NewHandler("default")
+	handler.Upstreams["public"] = public
+	handler.AddRuleConfig(&RuleConfig{Text: "suffix:games.example 0.0.0.0 schedule=later"}, nil, map[string]*Schedule{"later": later})
+	handler.AddRule("wildcard:* public")
+
+	ta.Equal("1.2.3.4", testServe(handler, "192.168.1.10", "www.games.example.").Answer[0].(*dns.A).A.String())
+
+	// the cached answer isn't used once the schedule starts
+	handler.Rules[0].SetSchedule(today)
+	ta.Equal("0.0.0.0", testServe(handler, "192.168.1.10", "www.games.example.").Answer[0].(*dns.A).A.String())
+	ta.Equal(1, public.queries)
+}
+
+func TestCheckConfig(t *testing.T) {
+	ta := assert.New(t)
+
+	filename := filepath.Join(t.TempDir(), "dohproxy.yml")
+	ta.Nil(os.WriteFile(filename, []byte(`
+upstreams:
+  public:
+    type: dns
+    address: 8.8.8.8:53
+schedules:
+  school-nights:
+    days: [sun-thu]
+    times: ["20:00-07:00"]
+rules:
+  - suffix:games.example reject schedule=school-nights
+  - wildcard:* public
+views:
+  kids:
+    rules:
+      - match:
+          any:
+            - suffix:youtube.com
+            - suffix:tiktok.com
+        upstream: reject
+        schedule: school-nights
+`), 0644))
+
+	output := &bytes.Buffer{}
+	CheckConfig([]string{filename}, output, time.Date(2020, 1, 3, 12, 0, 0, 0, time.Local))
+	ta.Equal(`view default
+  inactive  school-nights  suffix:games.example reject schedule=school-nights
+  active    -              wildcard:* public
+view kids
+  inactive  school-nights  match:any(suffix:youtube.com, suffix:tiktok.com)
+`, output.String())
+}
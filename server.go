@@ -1,12 +1,18 @@
 package main
 
 import (
-	"github.com/go-yaml/yaml"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"io/ioutil"
+	"net"
 	"net/url"
-	"os"
+	"strings"
 	"time"
 )
 
@@ -14,6 +20,7 @@ import (
 type Server interface {
 	Serve() error
 	Type() string
+	Name() string
 	Address() string
 	Handler() *Handler
 	SetHandler(handler *Handler)
@@ -21,6 +28,7 @@ type Server interface {
 
 // ServerImpl implements the Server interface
 type ServerImpl struct {
+	name    string
 	address string
 	handler *Handler
 }
@@ -30,6 +38,11 @@ func (s *ServerImpl) Address() string {
 	return s.address
 }
 
+// Name returns the listener name of a server
+func (s *ServerImpl) Name() string {
+	return s.name
+}
+
 // Handler returns the handler of a server
 func (s *ServerImpl) Handler() *Handler {
 	return s.handler
@@ -55,7 +68,7 @@ func (s *UDPServer) Serve() error {
 	srv := &dns.Server{
 		Addr:    s.address,
 		Net:     "udp",
-		Handler: s.handler,
+		Handler: &listenerHandler{handler: s.handler, listener: s.name},
 	}
 	zap.L().Named("server").Info("listening and serving",
 		zap.String("proto", "udp"),
@@ -74,7 +87,7 @@ func (s *TCPServer) Serve() error {
 	srv := &dns.Server{
 		Addr:    s.address,
 		Net:     "tcp",
-		Handler: s.handler,
+		Handler: &listenerHandler{handler: s.handler, listener: s.name},
 	}
 	zap.L().Named("server").Info("listening and serving",
 		zap.String("proto", "tcp"),
@@ -88,12 +101,249 @@ func (s *TCPServer) Type() string {
 	return "tcp"
 }
 
+// DoQServer is a implement of server using DNS-over-QUIC protocol
+type DoQServer struct {
+	ServerImpl
+	tlsConfig *tls.Config
+}
+
+// Serve starts the DNS-over-QUIC server
+func (s *DoQServer) Serve() error {
+	listener, err := quic.ListenAddrEarly(s.address, s.tlsConfig, &quic.Config{Allow0RTT: true})
+	if err != nil {
+		return err
+	}
+	zap.L().Named("server").Info("listening and serving",
+		zap.String("proto", "doq"),
+		zap.String("address", s.address),
+	)
+	return s.serve(listener)
+}
+
+func (s *DoQServer) serve(listener *quic.EarlyListener) error {
+	handler := &listenerHandler{handler: s.handler, listener: s.name}
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			return err
+		}
+		go serveDoQConn(conn, handler)
+	}
+}
+
+// Type returns a DNS-over-QUIC server type
+func (s *DoQServer) Type() string {
+	return "doq"
+}
+
 // Config describes the config file
 type Config struct {
-	Log       *LogConfig
-	Listen    []map[string]string
-	Upstreams map[string]map[string]string
-	Rules     []string
+	// Include is the config files, directories or glob patterns read after this file, relative to this file
+	Include       StringList
+	Log           *LogConfig
+	Listen        []*ListenConfig
+	Upstreams     map[string]*UpstreamConfig
+	Rules         []*RuleConfig
+	ResponseRules []string            `yaml:"response_rules"`
+	IPSets        map[string][]string `yaml:"ip_sets"`
+	Schedules     map[string]*ScheduleConfig
+	Views         map[string]*ViewConfig
+	// CNAMEInspection is the default of all the views
+	CNAMEInspection *bool `yaml:"cname_inspection"`
+	// RebindProtection is the default of all the views
+	RebindProtection *RebindConfig `yaml:"rebind_protection"`
+}
+
+// ViewConfig describes a named view, it has its own upstreams, rules and cache
+type ViewConfig struct {
+	Upstreams     map[string]*UpstreamConfig
+	Rules         []*RuleConfig
+	ResponseRules []string `yaml:"response_rules"`
+	// CNAMEInspection overrides the top level cname_inspection if set
+	CNAMEInspection *bool `yaml:"cname_inspection"`
+	// RebindProtection overrides the top level rebind_protection if set
+	RebindProtection *RebindConfig `yaml:"rebind_protection"`
+}
+
+// RuleConfig describes a rule in the config file, it's either a rule string or a structured rule
+type RuleConfig struct {
+	Text string
+
+	Match     interface{}
+	Upstream  string
+	Options   []string
+	Exception bool
+	Schedule  string
+}
+
+// UnmarshalYAML decodes a rule string or a structured rule
+func (c *RuleConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&c.Text); err == nil {
+		return nil
+	}
+
+	var structured struct {
+		Match     interface{}
+		Upstream  string
+		Options   []string
+		Exception bool
+		Schedule  string
+	}
+	if err := unmarshal(&structured); err != nil {
+		return err
+	}
+	if structured.Match == nil {
+		return errors.New("structured rule requires match")
+	}
+	c.Match = structured.Match
+	c.Upstream = structured.Upstream
+	c.Options = structured.Options
+	c.Exception = structured.Exception
+	c.Schedule = structured.Schedule
+	return nil
+}
+
+// ListenConfig describes a listen entry in the config file
+type ListenConfig struct {
+	Type    string
+	Address string
+	// Name is used by the listener conditions, default: type://address
+	Name string
+	// View is the view name the listener is bound to, default: default
+	View string
+	// Cert and Key are the certificate and private key files of the doq listeners
+	Cert string
+	Key  string
+}
+
+// UnmarshalYAML decodes a listen entry and fills the defaults
+func (c *ListenConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ListenConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if c.Name == "" {
+		c.Name = c.Type + "://" + c.Address
+	}
+	if c.View == "" {
+		c.View = "default"
+	}
+	return nil
+}
+
+// UpstreamConfig describes an upstream in the config file, the attributes used depend on the upstream type
+type UpstreamConfig struct {
+	Type    string
+	Address string
+	// Proxy is the proxy URL of the doh upstreams
+	Proxy string
+	// Relay is the oblivious relay URL of the odoh upstreams
+	Relay string
+	// HTTP3 is the HTTP/3 mode of the doh upstreams, default: off
+	HTTP3 string `yaml:"http3"`
+	// Timeout is the request timeout of the doh and odoh upstreams, default: 5s
+	Timeout Duration
+	// Headers are the extra HTTP headers of the doh requests
+	Headers map[string]string
+	// UserAgent is the User-Agent header of the doh requests, default: the Go one
+	UserAgent string `yaml:"user_agent"`
+	// Accept is the Accept header of the doh requests, default: the media type of the upstream type
+	Accept string
+	// TLS is the TLS settings of the doh, odoh, dot and doq upstreams
+	TLS *UpstreamTLSConfig `yaml:"tls"`
+	// Bootstrap is the DNS servers resolving the host names of the doh, dot and doq upstreams, default: the system
+	// resolver
+	Bootstrap StringList
+	// BootstrapIPs is the pinned addresses of the host names of the doh, dot and doq upstreams
+	BootstrapIPs StringList `yaml:"bootstrap_ips"`
+	// File is the zone file of the zone upstreams, or the hosts files of the hosts upstreams
+	File StringList
+	// Origin is the zone origin of the zone upstreams
+	Origin string
+	// TTL is used by the hosts and reject upstreams, default: 60
+	TTL uint32
+	// Interval is how often the hosts files are checked for changes, default: 5s
+	Interval Duration
+	// Mode is the block mode of the reject upstreams, default: nodata
+	Mode string
+	// EDE is the extended DNS error of the reject upstreams, default: blocked
+	EDE string
+
+	// bootstrapIPs and certHashes are decoded from the sdns:// stamp in the address
+	bootstrapIPs []net.IP
+	certHashes   [][]byte
+}
+
+// newUpstreamConfig returns an upstream config with the defaults
+func newUpstreamConfig() *UpstreamConfig {
+	return &UpstreamConfig{
+		TTL:      defaultStaticTTL,
+		Interval: Duration(5 * time.Second),
+		Mode:     BlockModeNoData,
+		EDE:      "blocked",
+	}
+}
+
+// UnmarshalYAML decodes an upstream and fills the defaults
+func (c *UpstreamConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain UpstreamConfig
+	*c = *newUpstreamConfig()
+	return unmarshal((*plain)(c))
+}
+
+// UpstreamTLSConfig describes the TLS settings of an encrypted upstream
+type UpstreamTLSConfig struct {
+	// Cert and Key are the client certificate and key files of the mutual TLS
+	Cert string
+	Key  string
+	// CA is the CA bundle file verifying the server, default: the system roots
+	CA string
+	// Pins are the base64 SHA256 digests of the SubjectPublicKeyInfo, one of the certificates in the verified chain must match
+	Pins StringList
+	// MinVersion is the minimum TLS version, from 1.0 to 1.3, default: 1.2
+	MinVersion string `yaml:"min_version"`
+	// ServerName is the SNI and the name verified in the certificate, default: the host of the address
+	ServerName string `yaml:"server_name"`
+}
+
+// StringList is a list in the config file, which could also be written as a comma separated string
+type StringList []string
+
+// UnmarshalYAML decodes a YAML sequence or a comma separated string
+func (l *StringList) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		*l = nil
+		for _, item := range strings.Split(s, ",") {
+			*l = append(*l, strings.TrimSpace(item))
+		}
+		return nil
+	}
+	return unmarshal((*[]string)(l))
+}
+
+// Duration is a duration in the config file, written like 5s or 1m30s
+type Duration time.Duration
+
+// UnmarshalYAML decodes a duration string
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// RebindConfig describes the rebinding protection config structure
+type RebindConfig struct {
+	Enabled *bool
+	Mode    string
+	Allow   []string
 }
 
 // LogConfig describes the log config structure
@@ -103,13 +353,24 @@ type LogConfig struct {
 	Level  string
 }
 
-func checkMapAttrs(m map[string]string, parentKey string, keys ...string) {
-	for _, key := range keys {
-		if _, ok := m[key]; !ok {
+func loadRebindProtection(config *RebindConfig) *RebindProtection {
+	if config == nil || (config.Enabled != nil && !*config.Enabled) {
+		return nil
+	}
+	protection, err := NewRebindProtection(config)
+	if err != nil {
+		zap.L().Named("config").Fatal("rebinding protection config error", zap.Error(err))
+	}
+	return protection
+}
+
+// checkRequired fatals if any of the required attributes is empty, attrs maps the keys to the values
+func checkRequired(parentKey string, attrs map[string]string) {
+	for key, value := range attrs {
+		if value == "" {
 			zap.L().Named("config").Fatal("lost key", zap.String("field", parentKey), zap.String("lost key", key))
 		}
 	}
-
 }
 
 func reloadLogConfig(logConfig *LogConfig) {
@@ -149,113 +410,513 @@ func reloadLogConfig(logConfig *LogConfig) {
 	initLog(stdout, stderr, level)
 }
 
-// LoadServersFromConfig loads the config file in YAML format into Server slice objects
-func LoadServersFromConfig(configPath string) []Server {
+// loadBootstrap returns the bootstrap of an upstream, or nil to use the system resolver, the pinned addresses in the
+// config take precedence over the ones in the sdns:// stamp
+func loadBootstrap(name string, upstreamConfig *UpstreamConfig) *Bootstrap {
 	logger := zap.L().Named("config")
 
-	logger.Info("reading config file", zap.String("filename", configPath))
-	startTime := time.Now()
+	ips := upstreamConfig.bootstrapIPs
+	if len(upstreamConfig.BootstrapIPs) > 0 {
+		ips = nil
+		for _, s := range upstreamConfig.BootstrapIPs {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				logger.Fatal("bootstrap ip parse error", zap.String("upstream name", name), zap.String("bootstrap_ips", s))
+			}
+			ips = append(ips, ip)
+		}
+	}
+	for _, server := range upstreamConfig.Bootstrap {
+		host, _, err := net.SplitHostPort(server)
+		if err != nil {
+			host = server
+		}
+		if net.ParseIP(strings.Trim(host, "[]")) == nil {
+			logger.Fatal("bootstrap server must be an ip address", zap.String("upstream name", name), zap.String("bootstrap", server))
+		}
+	}
+
+	if len(ips) == 0 && len(upstreamConfig.Bootstrap) == 0 {
+		return nil
+	}
+	return NewBootstrap(upstreamConfig.Bootstrap, upstreamHost(upstreamConfig), ips)
+}
 
-	yamlFile, err := os.Open(configPath)
-	defer yamlFile.Close()
+// upstreamHost returns the host name the encrypted upstream connects to, which the pinned addresses belong to, the odoh
+// upstreams connect to the relay
+func upstreamHost(upstreamConfig *UpstreamConfig) string {
+	address := upstreamConfig.Address
+	switch upstreamConfig.Type {
+	case "dot":
+		host, _, _ := splitUpstreamAddress(address, "tls://", dotDefaultPort)
+		return host
+	case "doq":
+		host, _, _ := splitUpstreamAddress(address, "quic://", doqDefaultPort)
+		return host
+	case "odoh":
+		address = upstreamConfig.Relay
+	}
+	u, err := url.Parse(address)
 	if err != nil {
-		logger.Fatal("can't open config file", zap.String("filename", configPath))
+		return ""
+	}
+	return u.Hostname()
+}
+
+// loadUpstreamTLSConfig creates the TLS config of an encrypted upstream, an empty serverName lets the client verify
+// the host of the address
+func loadUpstreamTLSConfig(name string, upstreamConfig *UpstreamConfig, serverName string) *tls.Config {
+	logger := zap.L().Named("config")
+
+	options := upstreamConfig.TLS
+	if options == nil {
+		return newUpstreamTLSConfig(serverName, upstreamConfig.certHashes)
 	}
+	if options.ServerName != "" {
+		serverName = options.ServerName
+	}
+	tlsConfig := newUpstreamTLSConfig(serverName, upstreamConfig.certHashes)
 
-	configMap := &Config{}
-	yaml.NewDecoder(yamlFile).Decode(configMap)
+	if options.Cert != "" || options.Key != "" {
+		checkRequired("upstream tls", map[string]string{"cert": options.Cert, "key": options.Key})
+		cert, err := tls.LoadX509KeyPair(options.Cert, options.Key)
+		if err != nil {
+			logger.Fatal("load upstream client certificate failed", zap.String("upstream name", name), zap.Error(err))
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if options.CA != "" {
+		data, err := ioutil.ReadFile(options.CA)
+		if err != nil {
+			logger.Fatal("read upstream ca file failed", zap.String("upstream name", name), zap.Error(err))
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			logger.Fatal("no certificate in the upstream ca file", zap.String("upstream name", name), zap.String("ca", options.CA))
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if len(options.Pins) > 0 {
+		var pins [][]byte
+		for _, s := range options.Pins {
+			pin, err := parseSPKIPin(s)
+			if err != nil {
+				logger.Fatal("upstream spki pin parse error", zap.String("upstream name", name), zap.String("pin", s), zap.Error(err))
+			}
+			pins = append(pins, pin)
+		}
+		pinUpstreamSPKI(tlsConfig, pins)
+	}
+	if options.MinVersion != "" {
+		version, ok := tlsVersions[options.MinVersion]
+		if !ok {
+			logger.Fatal("unknown upstream tls min_version", zap.String("upstream name", name), zap.String("min_version", options.MinVersion))
+		}
+		tlsConfig.MinVersion = version
+	}
+	return tlsConfig
+}
 
-	// log
-	reloadLogConfig(configMap.Log)
+// loadUpstreamDoh creates the common part of the doh upstreams
+func loadUpstreamDoh(name string, upstreamConfig *UpstreamConfig, defaultAccept string) UpstreamDoh {
+	logger := zap.L().Named("config")
 
-	// upstreams
-	handler := &Handler{
-		Upstreams: map[string]Upstream{
-			"blackhole": &UpstreamBlackHole{},
-			"reject":    &UpstreamReject{},
+	u, template, err := parseDohTemplate(upstreamConfig.Address)
+	if err != nil {
+		logger.Fatal("doh url parse error", zap.String("upstream name", name), zap.String("address", upstreamConfig.Address), zap.Error(err))
+	}
+	if upstreamConfig.Timeout < 0 {
+		logger.Fatal("doh timeout must be positive", zap.String("upstream name", name), zap.Duration("timeout", time.Duration(upstreamConfig.Timeout)))
+	}
+	accept := upstreamConfig.Accept
+	if accept == "" {
+		accept = defaultAccept
+	}
+	header, err := newDohHeader(accept, upstreamConfig.UserAgent, upstreamConfig.Headers)
+	if err != nil {
+		logger.Fatal("doh headers error", zap.String("upstream name", name), zap.Error(err))
+	}
+	var proxyURL *url.URL
+	if upstreamConfig.Proxy != "" {
+		proxyURL, err = url.Parse(upstreamConfig.Proxy)
+		if err != nil {
+			logger.Fatal("upstream proxy url parse error", zap.String("upstream name", name), zap.String("proxy", upstreamConfig.Proxy))
+		}
+	}
+	client, err := newDohClient(u, &dohClientOptions{
+		Proxy:     proxyURL,
+		Timeout:   time.Duration(upstreamConfig.Timeout),
+		HTTP3:     upstreamConfig.HTTP3,
+		TLSConfig: loadUpstreamTLSConfig(name, upstreamConfig, u.Hostname()),
+		Bootstrap: loadBootstrap(name, upstreamConfig),
+	})
+	if err != nil {
+		logger.Fatal("doh upstream config error", zap.String("upstream name", name), zap.Error(err))
+	}
+
+	return UpstreamDoh{
+		UpstreamImpl: UpstreamImpl{
+			name:    name,
+			address: upstreamConfig.Address,
+		},
+		url:      u,
+		template: template,
+		header:   header,
+		client:   client,
+	}
+}
+
+// loadUpstreamODoH creates an odoh upstream, the target config and the queries are sent by the same client
+func loadUpstreamODoH(name string, upstreamConfig *UpstreamConfig) *UpstreamODoH {
+	logger := zap.L().Named("config")
+
+	checkRequired("upstream", map[string]string{"relay": upstreamConfig.Relay})
+	// the headers would tell the relay and the target apart from the other clients
+	if len(upstreamConfig.Headers) > 0 || upstreamConfig.UserAgent != "" || upstreamConfig.Accept != "" || upstreamConfig.HTTP3 != "" {
+		logger.Fatal("odoh upstream doesn't support headers, user_agent, accept or http3", zap.String("upstream name", name))
+	}
+	target, err := url.Parse(upstreamConfig.Address)
+	if err != nil || target.Host == "" {
+		logger.Fatal("odoh target url parse error", zap.String("upstream name", name), zap.String("address", upstreamConfig.Address))
+	}
+	relay, err := url.Parse(upstreamConfig.Relay)
+	if err != nil || relay.Host == "" {
+		logger.Fatal("odoh relay url parse error", zap.String("upstream name", name), zap.String("relay", upstreamConfig.Relay))
+	}
+	var proxyURL *url.URL
+	if upstreamConfig.Proxy != "" {
+		proxyURL, err = url.Parse(upstreamConfig.Proxy)
+		if err != nil {
+			logger.Fatal("upstream proxy url parse error", zap.String("upstream name", name), zap.String("proxy", upstreamConfig.Proxy))
+		}
+	}
+	// the target config and the queries are fetched by the same client from different hosts, so only the options fit
+	// for both of them are allowed
+	if tlsOptions := upstreamConfig.TLS; tlsOptions != nil &&
+		(tlsOptions.ServerName != "" || tlsOptions.Cert != "" || tlsOptions.Key != "" || tlsOptions.CA != "" || len(tlsOptions.Pins) > 0) {
+		logger.Fatal("odoh upstream only supports the tls min_version", zap.String("upstream name", name))
+	}
+	if upstreamConfig.Timeout < 0 {
+		logger.Fatal("odoh timeout must be positive", zap.String("upstream name", name), zap.Duration("timeout", time.Duration(upstreamConfig.Timeout)))
+	}
+	client, err := newDohClient(relay, &dohClientOptions{
+		Proxy:     proxyURL,
+		Timeout:   time.Duration(upstreamConfig.Timeout),
+		TLSConfig: loadUpstreamTLSConfig(name, upstreamConfig, ""),
+		Bootstrap: loadBootstrap(name, upstreamConfig),
+	})
+	if err != nil {
+		logger.Fatal("odoh upstream config error", zap.String("upstream name", name), zap.Error(err))
+	}
+
+	return &UpstreamODoH{
+		UpstreamImpl: UpstreamImpl{
+			name:    name,
+			address: upstreamConfig.Address,
 		},
-		Rules: []Rule{},
+		client: NewODoHClient(target, relay, client),
 	}
-	for name, upstreamConfig := range configMap.Upstreams {
-		checkMapAttrs(upstreamConfig, "upstream", "type", "address")
+}
+
+// loadUpstreams converts the upstream configs into Upstream objects and adds them to the handler
+func loadUpstreams(handler *Handler, upstreams map[string]*UpstreamConfig) {
+	logger := zap.L().Named("config")
+
+	for name, upstreamConfig := range upstreams {
+		if upstreamConfig == nil {
+			upstreamConfig = newUpstreamConfig()
+		}
+		if strings.HasPrefix(upstreamConfig.Address, stampPrefix) {
+			if err := applyStamp(upstreamConfig); err != nil {
+				logger.Fatal("upstream stamp decode error", zap.String("upstream name", name), zap.Error(err))
+			}
+		}
+		checkRequired("upstream", map[string]string{"type": upstreamConfig.Type})
+		switch upstreamConfig.Type {
+		case "zone", "hosts":
+			checkRequired("upstream", map[string]string{"file": strings.Join(upstreamConfig.File, ",")})
+		case "reject", "blackhole":
+		default:
+			checkRequired("upstream", map[string]string{"address": upstreamConfig.Address})
+		}
 
-		switch upstreamConfig["type"] {
+		switch upstreamConfig.Type {
 		case "dns":
 			upstream := &UpstreamDNS{
 				UpstreamImpl{
 					name:    name,
-					address: upstreamConfig["address"],
+					address: upstreamConfig.Address,
 				},
 			}
 			handler.Upstreams[name] = upstream
 		case "doh", "doh-get":
-			upstream := &UpstreamDohGet{
-				UpstreamDoh{
-					UpstreamImpl: UpstreamImpl{
-						name:    name,
-						address: upstreamConfig["address"],
-					},
+			handler.Upstreams[name] = &UpstreamDohGet{loadUpstreamDoh(name, upstreamConfig, dohContentType)}
+		case "doh-post":
+			handler.Upstreams[name] = &UpstreamDohPost{loadUpstreamDoh(name, upstreamConfig, dohContentType)}
+		case "doh-json":
+			handler.Upstreams[name] = &UpstreamDohJSON{loadUpstreamDoh(name, upstreamConfig, dohJSONAccept)}
+		case "doq":
+			client, err := NewDoQClient(upstreamConfig.Address, loadUpstreamTLSConfig(name, upstreamConfig, ""), loadBootstrap(name, upstreamConfig))
+			if err != nil {
+				logger.Fatal("doq upstream config error", zap.String("upstream name", name), zap.Error(err))
+			}
+			handler.Upstreams[name] = &UpstreamDoQ{
+				UpstreamImpl: UpstreamImpl{
+					name:    name,
+					address: upstreamConfig.Address,
 				},
+				client: client,
 			}
-			if proxyStr, ok := upstreamConfig["proxy"]; ok {
-				proxyURL, err := url.Parse(proxyStr)
-				if err != nil {
-					logger.Fatal("upstream proxy url parse error", zap.String("upstream name", name), zap.String("proxy", proxyStr))
-				}
-				upstream.proxy = proxyURL
+		case "dot":
+			client, err := NewDoTClient(upstreamConfig.Address, loadUpstreamTLSConfig(name, upstreamConfig, ""), loadBootstrap(name, upstreamConfig))
+			if err != nil {
+				logger.Fatal("dot upstream config error", zap.String("upstream name", name), zap.Error(err))
 			}
-			handler.Upstreams[name] = upstream
-		case "doh-post":
-			upstream := &UpstreamDohPost{
-				UpstreamDoh{
-					UpstreamImpl: UpstreamImpl{
-						name:    name,
-						address: upstreamConfig["address"],
-					},
+			handler.Upstreams[name] = &UpstreamDoT{
+				UpstreamImpl: UpstreamImpl{
+					name:    name,
+					address: upstreamConfig.Address,
 				},
+				client: client,
 			}
-			if proxyStr, ok := upstreamConfig["proxy"]; ok {
-				proxyURL, err := url.Parse(proxyStr)
-				if err != nil {
-					logger.Fatal("upstream proxy url parse error", zap.String("upstream name", name), zap.String("proxy", proxyStr))
-				}
-				upstream.proxy = proxyURL
+		case "odoh":
+			handler.Upstreams[name] = loadUpstreamODoH(name, upstreamConfig)
+		case "dnscrypt":
+			client, err := NewDNSCryptClient(upstreamConfig.Address)
+			if err != nil {
+				logger.Fatal("dnscrypt upstream config error", zap.String("upstream name", name), zap.Error(err))
+			}
+			handler.Upstreams[name] = &UpstreamDNSCrypt{
+				UpstreamImpl: UpstreamImpl{
+					name:    name,
+					address: upstreamConfig.Address,
+				},
+				client: client,
+			}
+		case "zone":
+			if len(upstreamConfig.File) != 1 {
+				logger.Fatal("zone upstream requires exactly 1 file", zap.String("upstream name", name), zap.Strings("files", upstreamConfig.File))
+			}
+			zone, err := LoadZoneFile(upstreamConfig.File[0], upstreamConfig.Origin)
+			if err != nil {
+				logger.Fatal("load zone file failed", zap.String("upstream name", name), zap.String("file", upstreamConfig.File[0]), zap.Error(err))
+			}
+			logger.Info("zone loaded", zap.String("upstream name", name), zap.String("origin", zone.Origin()), zap.Int("names", len(zone.records)))
+			handler.Upstreams[name] = &UpstreamZone{
+				UpstreamImpl: UpstreamImpl{
+					name:    name,
+					address: upstreamConfig.File[0],
+				},
+				zone: zone,
+			}
+		case "hosts":
+			interval := time.Duration(upstreamConfig.Interval)
+			if interval <= 0 {
+				logger.Fatal("upstream interval must be positive", zap.String("upstream name", name), zap.Duration("interval", interval))
+			}
+			hosts, err := NewHosts(upstreamConfig.File, upstreamConfig.TTL)
+			if err != nil {
+				logger.Fatal("read hosts files failed", zap.String("upstream name", name), zap.Strings("files", upstreamConfig.File), zap.Error(err))
+			}
+			handler.Upstreams[name] = &UpstreamHosts{
+				UpstreamImpl: UpstreamImpl{
+					name:    name,
+					address: strings.Join(upstreamConfig.File, ","),
+				},
+				hosts:    hosts,
+				interval: interval,
+			}
+		case "reject":
+			var addresses []string
+			if upstreamConfig.Address != "" {
+				addresses = strings.Split(upstreamConfig.Address, ",")
+			}
+			block, err := NewBlockResponse(upstreamConfig.Mode, upstreamConfig.TTL, addresses, upstreamConfig.EDE)
+			if err != nil {
+				logger.Fatal("reject upstream config error", zap.String("upstream name", name), zap.Error(err))
+			}
+			handler.Upstreams[name] = &UpstreamReject{
+				UpstreamImpl: UpstreamImpl{
+					name: name,
+				},
+				block: block,
+			}
+		case "blackhole":
+			// a black hole never answers, the block responses are made by the reject upstreams
+			if upstreamConfig.Address != "" || upstreamConfig.Mode != BlockModeNoData || upstreamConfig.EDE != "blocked" {
+				logger.Fatal("blackhole upstream doesn't support address, mode or ede, use a reject upstream instead", zap.String("upstream name", name))
+			}
+			handler.Upstreams[name] = &UpstreamBlackHole{
+				UpstreamImpl{
+					name: name,
+				},
 			}
-			handler.Upstreams[name] = upstream
 		default:
-			logger.Fatal("unknown upstream type", zap.String("type", upstreamConfig["type"]))
+			logger.Fatal("unknown upstream type", zap.String("type", upstreamConfig.Type))
 		}
 	}
+}
+
+// LoadServersFromConfig loads the config files in YAML format into Server slice objects
+func LoadServersFromConfig(ctx context.Context, configPaths ...string) []Server {
+	servers, handlers := LoadConfig(configPaths...)
+	watchHosts(ctx, handlers)
+	return servers
+}
+
+// watchHosts starts watching the files of the hosts upstreams until the context is done, the upstreams shared by the
+// views are watched once
+func watchHosts(ctx context.Context, handlers map[string]*Handler) {
+	watched := map[*Hosts]bool{}
+	for _, handler := range handlers {
+		for _, upstream := range handler.Upstreams {
+			if upstream, ok := upstream.(*UpstreamHosts); ok && !watched[upstream.hosts] {
+				watched[upstream.hosts] = true
+				go upstream.hosts.Watch(ctx, upstream.interval)
+			}
+		}
+	}
+}
+
+// LoadConfig loads the config files in YAML format into Server slice objects and the view handlers by name, see
+// ReadConfig for how the files are merged
+func LoadConfig(configPaths ...string) ([]Server, map[string]*Handler) {
+	return loadConfig(configPaths, true)
+}
+
+// loadConfig loads the config files, the log config is applied if reloadLog is set
+func loadConfig(configPaths []string, reloadLog bool) ([]Server, map[string]*Handler) {
+	logger := zap.L().Named("config")
+
+	startTime := time.Now()
+
+	configMap, err := ReadConfig(configPaths)
+	if err != nil {
+		logger.Fatal("config read error", zap.Strings("paths", configPaths), zap.Error(err))
+	}
+
+	// log
+	if reloadLog {
+		reloadLogConfig(configMap.Log)
+	}
 
-	// rules
+	// ip sets
+	ipSets := map[string]*IPSet{}
+	for name, entries := range configMap.IPSets {
+		ipSet, err := ParseIPSet(entries)
+		if err != nil {
+			logger.Fatal("ip set parse error", zap.String("ip set", name), zap.Error(err))
+		}
+		ipSets[name] = ipSet
+	}
+
+	// schedules
+	schedules := map[string]*Schedule{}
+	for name, scheduleConfig := range configMap.Schedules {
+		schedule, err := NewSchedule(name, scheduleConfig)
+		if err != nil {
+			logger.Fatal("schedule parse error", zap.String("schedule", name), zap.Error(err))
+		}
+		schedules[name] = schedule
+	}
+
+	// the default view
+	handler := NewHandler("default")
+	handler.CNAMEInspection = configMap.CNAMEInspection != nil && *configMap.CNAMEInspection
+	handler.RebindProtection = loadRebindProtection(configMap.RebindProtection)
+	loadUpstreams(handler, configMap.Upstreams)
 	for _, rule := range configMap.Rules {
-		handler.AddRule(rule)
+		handler.AddRuleConfig(rule, ipSets, schedules)
+	}
+	for _, rule := range configMap.ResponseRules {
+		handler.AddResponseRule(rule, ipSets)
+	}
+
+	// views
+	handlers := map[string]*Handler{"default": handler}
+	for name, viewConfig := range configMap.Views {
+		if name == "default" {
+			logger.Fatal("view name is reserved for the top level upstreams and rules", zap.String("view", name))
+		}
+		viewHandler := NewHandler(name)
+		viewHandler.CNAMEInspection = handler.CNAMEInspection
+		viewHandler.RebindProtection = handler.RebindProtection
+		// a view can use all the upstreams defined at the top level
+		for upstreamName, upstream := range handler.Upstreams {
+			viewHandler.Upstreams[upstreamName] = upstream
+		}
+		if viewConfig != nil {
+			if viewConfig.CNAMEInspection != nil {
+				viewHandler.CNAMEInspection = *viewConfig.CNAMEInspection
+			}
+			if viewConfig.RebindProtection != nil {
+				viewHandler.RebindProtection = loadRebindProtection(viewConfig.RebindProtection)
+			}
+			loadUpstreams(viewHandler, viewConfig.Upstreams)
+			for _, rule := range viewConfig.Rules {
+				viewHandler.AddRuleConfig(rule, ipSets, schedules)
+			}
+			for _, rule := range viewConfig.ResponseRules {
+				viewHandler.AddResponseRule(rule, ipSets)
+			}
+		}
+		handlers[name] = viewHandler
 	}
 
 	// listen
 	var servers []Server
 	listen := configMap.Listen
 	for _, serverConfig := range listen {
-		checkMapAttrs(serverConfig, "listen", "type", "address")
-		switch serverConfig["type"] {
+		if serverConfig == nil {
+			serverConfig = &ListenConfig{}
+		}
+		checkRequired("listen", map[string]string{"type": serverConfig.Type, "address": serverConfig.Address})
+
+		viewHandler, ok := handlers[serverConfig.View]
+		if !ok {
+			logger.Fatal("unknown view", zap.String("view", serverConfig.View), zap.String("address", serverConfig.Address))
+		}
+
+		switch serverConfig.Type {
 		case "udp":
 			server := &UDPServer{
 				ServerImpl{
-					address: serverConfig["address"],
-					handler: handler,
+					name:    serverConfig.Name,
+					address: serverConfig.Address,
+					handler: viewHandler,
 				},
 			}
 			servers = append(servers, server)
 		case "tcp":
 			server := &TCPServer{
 				ServerImpl{
-					address: serverConfig["address"],
-					handler: handler,
+					name:    serverConfig.Name,
+					address: serverConfig.Address,
+					handler: viewHandler,
+				},
+			}
+			servers = append(servers, server)
+		case "doq":
+			checkRequired("listen", map[string]string{"cert": serverConfig.Cert, "key": serverConfig.Key})
+			cert, err := tls.LoadX509KeyPair(serverConfig.Cert, serverConfig.Key)
+			if err != nil {
+				logger.Fatal("load listen certificate failed", zap.String("address", serverConfig.Address), zap.Error(err))
+			}
+			server := &DoQServer{
+				ServerImpl: ServerImpl{
+					name:    serverConfig.Name,
+					address: serverConfig.Address,
+					handler: viewHandler,
+				},
+				tlsConfig: &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					NextProtos:   []string{doqALPN},
+					MinVersion:   tls.VersionTLS13,
 				},
 			}
 			servers = append(servers, server)
 		default:
-			logger.Fatal("unknown listen type", zap.String("type", serverConfig["type"]))
+			logger.Fatal("unknown listen type", zap.String("type", serverConfig.Type))
 		}
 	}
 
@@ -264,7 +925,9 @@ func LoadServersFromConfig(configPath string) []Server {
 		zap.Int("servers", len(servers)),
 		zap.Int("upstreams", len(configMap.Upstreams)),
 		zap.Int("rules", len(configMap.Rules)),
+		zap.Int("response rules", len(configMap.ResponseRules)),
+		zap.Int("views", len(handlers)),
 	)
 
-	return servers
+	return servers, handlers
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"github.com/go-yaml/yaml"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_Decode(t *testing.T) {
+	ta := assert.New(t)
+
+	config := &Config{}
+	ta.Nil(yaml.UnmarshalStrict([]byte(`
+listen:
+  - type: udp
+    address: 127.0.0.1:53
+  - type: udp
+    address: 10.8.0.1:53
+    name: vpn-udp
+    view: vpn
+upstreams:
+  lab-hosts:
+    type: hosts
+    file: /etc/hosts, /etc/dohproxy/lab.hosts
+    interval: 1m
+  more-hosts:
+    type: hosts
+    file: [/etc/hosts]
+    ttl: 300
+  blackhole:
+rules:
+  - wildcard:* lab-hosts
+views:
+  vpn:
+    upstreams:
+      block-page:
+        type: reject
+        mode: sinkhole
+        address: 10.0.0.80
+`), config))
+
+	ta.Equal("udp://127.0.0.1:53", config.Listen[0].Name)
+	ta.Equal("default", config.Listen[0].View)
+	ta.Equal("vpn-udp", config.Listen[1].Name)
+	ta.Equal("vpn", config.Listen[1].View)
+
+	hosts := config.Upstreams["lab-hosts"]
+	ta.Equal(StringList{"/etc/hosts", "/etc/dohproxy/lab.hosts"}, hosts.File)
+	ta.Equal(Duration(time.Minute), hosts.Interval)
+	ta.Equal(uint32(defaultStaticTTL), hosts.TTL)
+
+	hosts = config.Upstreams["more-hosts"]
+	ta.Equal(StringList{"/etc/hosts"}, hosts.File)
+	ta.Equal(Duration(5*time.Second), hosts.Interval)
+	ta.Equal(uint32(300), hosts.TTL)
+
+	ta.Nil(config.Upstreams["blackhole"])
+	// the empty entries get the same defaults when they are loaded
+	empty := &Config{}
+	ta.Nil(yaml.UnmarshalStrict([]byte("upstreams:\n  empty: {}\n"), empty))
+	ta.Equal(newUpstreamConfig(), empty.Upstreams["empty"])
+
+	reject := config.Views["vpn"].Upstreams["block-page"]
+	ta.Equal(BlockModeSinkhole, reject.Mode)
+	ta.Equal("blocked", reject.EDE)
+
+	// typos and wrong types are errors
+	for _, text := range []string{
+		"listen:\n  - type: udp\n    adress: 127.0.0.1:53\n",
+		"upstreams:\n  google:\n    tyep: dns\n    address: 8.8.8.8:53\n",
+		"upstreams:\n  lab-hosts:\n    type: hosts\n    file: /etc/hosts\n    interval: often\n",
+		"upstreams:\n  lab-hosts:\n    type: hosts\n    file: /etc/hosts\n    ttl: -1\n",
+		"rules:\n  - match: suffix:corp.com\n    upstrem: corp\n",
+		"cname_inspection: sure\n",
+		"rule:\n  - wildcard:* google\n",
+	} {
+		ta.NotNil(yaml.UnmarshalStrict([]byte(text), &Config{}), text)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"github.com/ameshkov/dnsstamps"
+	"net"
+	"slices"
+	"strings"
+)
+
+// stampPrefix is the prefix of the DNS stamps, https://dnscrypt.info/stamps-specifications
+const stampPrefix = "sdns://"
+
+// stampDefaultPorts are the ports dnsstamps adds to the server addresses without one, they are left out of the
+// upstream addresses so the upstream default ports are used, dnsstamps still has the draft ports of DoT and DoQ
+var stampDefaultPorts = map[dnsstamps.StampProtoType]string{
+	dnsstamps.StampProtoTypeDoH: "443",
+	dnsstamps.StampProtoTypeTLS: "843",
+	dnsstamps.StampProtoTypeDoQ: "784",
+}
+
+// stampTypes are the upstream types of the stamp protocols, the first one is the default
+var stampTypes = map[dnsstamps.StampProtoType][]string{
+	dnsstamps.StampProtoTypePlain:    {"dns"},
+	dnsstamps.StampProtoTypeDNSCrypt: {"dnscrypt"},
+	dnsstamps.StampProtoTypeDoH:      {"doh", "doh-get", "doh-post"},
+	dnsstamps.StampProtoTypeTLS:      {"dot"},
+	dnsstamps.StampProtoTypeDoQ:      {"doq"},
+}
+
+// applyStamp decodes the sdns:// stamp in the upstream address, the address is replaced with the one of the upstream
+// type, and the server address and the certificate hashes in the stamp are kept as the bootstrap address and the
+// cert hashes of the upstream
+func applyStamp(config *UpstreamConfig) error {
+	stamp, err := dnsstamps.NewServerStampFromString(config.Address)
+	if err != nil {
+		return err
+	}
+	types, ok := stampTypes[stamp.Proto]
+	if !ok {
+		return fmt.Errorf("unsupported stamp protocol %s", stamp.Proto.String())
+	}
+	if config.Type == "" {
+		config.Type = types[0]
+	} else if !slices.Contains(types, config.Type) {
+		return fmt.Errorf("a %s stamp can't be used by a %s upstream", stamp.Proto.String(), config.Type)
+	}
+
+	switch stamp.Proto {
+	case dnsstamps.StampProtoTypePlain:
+		config.Address = stamp.ServerAddrStr
+		return nil
+	case dnsstamps.StampProtoTypeDNSCrypt:
+		// the dnscrypt upstream reads the stamp itself
+		return nil
+	}
+
+	if stamp.ProviderName == "" {
+		return fmt.Errorf("the %s stamp has no host name", stamp.Proto.String())
+	}
+	// the server address is the bootstrap address, its port is used if the host name has none
+	ip, port := splitStampServerAddress(stamp.ServerAddrStr)
+	authority := stamp.ProviderName
+	if _, _, err := net.SplitHostPort(authority); err != nil && port != "" && port != stampDefaultPorts[stamp.Proto] {
+		authority = net.JoinHostPort(strings.Trim(authority, "[]"), port)
+	}
+
+	switch stamp.Proto {
+	case dnsstamps.StampProtoTypeDoH:
+		config.Address = "https://" + authority + stamp.Path
+	case dnsstamps.StampProtoTypeTLS:
+		config.Address = "tls://" + authority
+	case dnsstamps.StampProtoTypeDoQ:
+		config.Address = "quic://" + authority
+	}
+	if ip != nil {
+		config.bootstrapIPs = []net.IP{ip}
+	}
+	config.certHashes = stamp.Hashes
+	return nil
+}
+
+// splitStampServerAddress returns the IP and the port of the server address in a stamp, which could be empty, an IP,
+// or an IP with a port
+func splitStampServerAddress(address string) (net.IP, string) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host, port = address, ""
+	}
+	return net.ParseIP(strings.Trim(host, "[]")), port
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"github.com/ameshkov/dnsstamps"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestApplyStamp(t *testing.T) {
+	ta := assert.New(t)
+
+	hash := make([]byte, 32)
+	hash[0] = 0x01
+	stamp := func(s dnsstamps.ServerStamp) string {
+		return s.String()
+	}
+
+	for _, c := range []struct {
+		stamp     string
+		upType    string
+		wantType  string
+		address   string
+		bootstrap string
+	}{
+		{stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypePlain, ServerAddrStr: "9.9.9.9"}), "", "dns", "9.9.9.9:53", ""},
+		{stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDoH, ServerAddrStr: "1.1.1.1", ProviderName: "dns.example.com", Path: "/dns-query", Hashes: [][]byte{hash}}), "", "doh", "https://dns.example.com/dns-query", "1.1.1.1"},
+		{stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDoH, ServerAddrStr: "1.1.1.1:8443", ProviderName: "dns.example.com", Path: "/dns-query"}), "doh-post", "doh-post", "https://dns.example.com:8443/dns-query", "1.1.1.1"},
+		{stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDoH, ProviderName: "dns.example.com:444", Path: "/q"}), "", "doh", "https://dns.example.com:444/q", ""},
+		{stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeTLS, ServerAddrStr: "[2620:fe::fe]", ProviderName: "dns.example.com"}), "", "dot", "tls://dns.example.com", "2620:fe::fe"},
+		{stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDoQ, ServerAddrStr: "9.9.9.9:8853", ProviderName: "dns.example.com"}), "", "doq", "quic://dns.example.com:8853", "9.9.9.9"},
+	} {
+		config := &UpstreamConfig{Type: c.upType, Address: c.stamp}
+		ta.Nil(applyStamp(config), c.stamp)
+		ta.Equal(c.wantType, config.Type, c.stamp)
+		ta.Equal(c.address, config.Address, c.stamp)
+		if c.bootstrap == "" {
+			ta.Empty(config.bootstrapIPs, c.stamp)
+		} else if ta.Len(config.bootstrapIPs, 1, c.stamp) {
+			ta.Equal(c.bootstrap, config.bootstrapIPs[0].String(), c.stamp)
+		}
+	}
+
+	config := &UpstreamConfig{Address: stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeTLS, ServerAddrStr: "1.1.1.1", ProviderName: "dns.example.com", Hashes: [][]byte{hash}})}
+	ta.Nil(applyStamp(config))
+	ta.Equal([][]byte{hash}, config.certHashes)
+
+	// the dnscrypt upstream keeps the stamp
+	dnscryptStamp := stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypeDNSCrypt, ServerAddrStr: "1.1.1.1", ProviderName: "2.dnscrypt-cert.example.com", ServerPk: hash})
+	config = &UpstreamConfig{Address: dnscryptStamp}
+	ta.Nil(applyStamp(config))
+	ta.Equal("dnscrypt", config.Type)
+	ta.Equal(dnscryptStamp, config.Address)
+
+	// the explicit type must match the stamp protocol
+	ta.NotNil(applyStamp(&UpstreamConfig{Type: "dot", Address: stamp(dnsstamps.ServerStamp{Proto: dnsstamps.StampProtoTypePlain, ServerAddrStr: "9.9.9.9"})}))
+	ta.NotNil(applyStamp(&UpstreamConfig{Address: "sdns://invalid"}))
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// defaultStaticTTL is the TTL of static records without the ttl option
+const defaultStaticTTL = 60
+
+// StaticAnswer describes the records a static rule answers with
+type StaticAnswer struct {
+	// Records holds the record templates, the owner names are filled with the question name at query time
+	Records []dns.RR
+	TTL     uint32
+	// Resolve makes the CNAME target resolved through the rules and appended to the answer
+	Resolve bool
+}
+
+// ParseStaticAnswer parses the rule target and options into a StaticAnswer
+//
+// The target is a comma separated record list, every record is an IPv4 or IPv6 address, or one of
+// cname=target, txt=text, mx=preference:host, srv=priority:weight:port:target.
+// The options could be ttl=seconds and resolve.
+func ParseStaticAnswer(target string, options []string) (*StaticAnswer, error) {
+	static := &StaticAnswer{TTL: defaultStaticTTL}
+
+	for _, option := range options {
+		key, value := splitKeyValue(option)
+		switch key {
+		case "ttl":
+			ttl, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ttl %q", value)
+			}
+			static.TTL = uint32(ttl)
+		case "resolve":
+			static.Resolve = true
+		default:
+			return nil, fmt.Errorf("unknown static option %q", option)
+		}
+	}
+
+	for _, item := range splitOutsideQuotes(target, func(r rune) bool { return r == ',' }) {
+		rr, err := parseStaticRecord(item)
+		if err != nil {
+			return nil, err
+		}
+		static.Records = append(static.Records, rr)
+	}
+	if len(static.Records) == 0 {
+		return nil, errors.New("no static records")
+	}
+
+	if static.CNAME() != "" && len(static.Records) > 1 {
+		return nil, errors.New("cname record can't be combined with other records")
+	}
+	if static.Resolve && static.CNAME() == "" {
+		return nil, errors.New("resolve option requires a cname record")
+	}
+
+	return static, nil
+}
+
+func parseStaticRecord(item string) (dns.RR, error) {
+	if ip := net.ParseIP(item); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &dns.A{Hdr: dns.RR_Header{Rrtype: dns.TypeA}, A: ip4}, nil
+		}
+		return &dns.AAAA{Hdr: dns.RR_Header{Rrtype: dns.TypeAAAA}, AAAA: ip}, nil
+	}
+
+	key, value := splitKeyValue(item)
+	if value == "" {
+		return nil, fmt.Errorf("invalid static record %q", item)
+	}
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		value = unquoted
+	}
+
+	switch key {
+	case "cname":
+		return &dns.CNAME{Hdr: dns.RR_Header{Rrtype: dns.TypeCNAME}, Target: dns.Fqdn(strings.ToLower(value))}, nil
+	case "txt":
+		return &dns.TXT{Hdr: dns.RR_Header{Rrtype: dns.TypeTXT}, Txt: []string{value}}, nil
+	case "mx":
+		fields := strings.Split(value, ":")
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("mx record must be preference:host, got %q", value)
+		}
+		preference, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mx preference %q", fields[0])
+		}
+		return &dns.MX{
+			Hdr:        dns.RR_Header{Rrtype: dns.TypeMX},
+			Preference: uint16(preference),
+			Mx:         dns.Fqdn(strings.ToLower(fields[1])),
+		}, nil
+	case "srv":
+		fields := strings.Split(value, ":")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("srv record must be priority:weight:port:target, got %q", value)
+		}
+		var numbers [3]uint16
+		for i := range numbers {
+			n, err := strconv.ParseUint(fields[i], 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("invalid srv number %q", fields[i])
+			}
+			numbers[i] = uint16(n)
+		}
+		return &dns.SRV{
+			Hdr:      dns.RR_Header{Rrtype: dns.TypeSRV},
+			Priority: numbers[0],
+			Weight:   numbers[1],
+			Port:     numbers[2],
+			Target:   dns.Fqdn(strings.ToLower(fields[3])),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown static record type %q", key)
+	}
+}
+
+// CNAME returns the cname target of the static answer, or an empty string if there isn't one
+func (static *StaticAnswer) CNAME() string {
+	for _, rr := range static.Records {
+		if cname, ok := rr.(*dns.CNAME); ok {
+			return cname.Target
+		}
+	}
+	return ""
+}
+
+// IsNull returns if all the records are the unspecified addresses 0.0.0.0 or ::, which blocks the name
+func (static *StaticAnswer) IsNull() bool {
+	for _, rr := range static.Records {
+		if ip := rrIP(rr); ip == nil || !ip.IsUnspecified() {
+			return false
+		}
+	}
+	return len(static.Records) > 0
+}
+
+// Reply builds the authoritative reply of the request, an empty answer means NODATA with a synthetic SOA
+func (static *StaticAnswer) Reply(req *dns.Msg) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+	msg.Authoritative = true
+
+	question := req.Question[0]
+	for _, record := range static.Records {
+		rrtype := record.Header().Rrtype
+		if rrtype != question.Qtype && rrtype != dns.TypeCNAME && question.Qtype != dns.TypeANY {
+			continue
+		}
+		rr := dns.Copy(record)
+		rr.Header().Name = question.Name
+		rr.Header().Class = dns.ClassINET
+		rr.Header().Ttl = static.TTL
+		msg.Answer = append(msg.Answer, rr)
+	}
+	if len(msg.Answer) == 0 {
+		msg.Ns = append(msg.Ns, syntheticSOA(question.Name, static.TTL))
+	}
+	return msg
+}
+
+// splitKeyValue splits a key=value string, the value is empty if there isn't a "="
+func splitKeyValue(s string) (string, string) {
+	if i := strings.Index(s, "="); i >= 0 {
+		return strings.ToLower(s[:i]), s[i+1:]
+	}
+	return strings.ToLower(s), ""
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseStaticAnswer(t *testing.T) {
+	ta := assert.New(t)
+
+	static, err := ParseStaticAnswer("10.0.0.1,fd00::1,txt=\"v=spf1 -all\",mx=10:mail.lan,srv=10:60:5060:sip.lan", []string{"ttl=300"})
+	ta.Nil(err)
+	ta.Len(static.Records, 5)
+	ta.Equal(uint32(300), static.TTL)
+	ta.Equal("v=spf1 -all", static.Records[2].(*dns.TXT).Txt[0])
+	ta.Equal("mail.lan.", static.Records[3].(*dns.MX).Mx)
+	ta.Equal(uint16(5060), static.Records[4].(*dns.SRV).Port)
+
+	static, err = ParseStaticAnswer("cname=www.google.com", []string{"resolve"})
+	ta.Nil(err)
+	ta.Equal("www.google.com.", static.CNAME())
+	ta.True(static.Resolve)
+
+	_, err = ParseStaticAnswer("cname=www.google.com,10.0.0.1", nil)
+	ta.NotNil(err)
+	_, err = ParseStaticAnswer("10.0.0.1", []string{"resolve"})
+	ta.NotNil(err)
+	_, err = ParseStaticAnswer("google-public", nil)
+	ta.NotNil(err)
+	_, err = ParseStaticAnswer("mx=mail.lan", nil)
+	ta.NotNil(err)
+}
+
+func TestStaticAnswer_Reply(t *testing.T) {
+	ta := assert.New(t)
+	static, _ := ParseStaticAnswer("10.0.0.1,10.0.0.2,fd00::1", nil)
+
+	req := &dns.Msg{}
+	req.SetQuestion("dual.lan.", dns.TypeA)
+	msg := static.Reply(req)
+	ta.Len(msg.Answer, 2)
+	ta.Equal("dual.lan.", msg.Answer[0].Header().Name)
+	ta.Equal(uint32(defaultStaticTTL), msg.Answer[0].Header().Ttl)
+
+	req.SetQuestion("dual.lan.", dns.TypeAAAA)
+	ta.Len(static.Reply(req).Answer, 1)
+
+	// NODATA
+	req.SetQuestion("dual.lan.", dns.TypeMX)
+	msg = static.Reply(req)
+	ta.Equal(dns.RcodeSuccess, msg.Rcode)
+	ta.Len(msg.Answer, 0)
+	ta.Equal(dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+	ta.Equal(uint32(defaultStaticTTL), msg.Ns[0].(*dns.SOA).Minttl)
+
+	// cname is answered for all types
+	static, _ = ParseStaticAnswer("cname=www.google.com", nil)
+	req.SetQuestion("alias.lan.", dns.TypeAAAA)
+	ta.Len(static.Reply(req).Answer, 1)
+
+	// the targets are lowercased
+	static, _ = ParseStaticAnswer("mx=10:Mail.LAN,srv=0:5:5060:SIP.lan", nil)
+	req.SetQuestion("lan.", dns.TypeANY)
+	msg = static.Reply(req)
+	ta.Equal("mail.lan.", msg.Answer[0].(*dns.MX).Mx)
+	ta.Equal("sip.lan.", msg.Answer[1].(*dns.SRV).Target)
+}
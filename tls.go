@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// newUpstreamTLSConfig creates the TLS config of an encrypted upstream, if there are cert hashes, one of the
+// certificates in the chain must have the SHA256 digest of its TBS certificate in them, like the sdns:// stamps require
+func newUpstreamTLSConfig(serverName string, certHashes [][]byte) *tls.Config {
+	tlsConfig := &tls.Config{ServerName: serverName}
+	if len(certHashes) > 0 {
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			for _, cert := range verifiedCertificates(state) {
+				digest := sha256.Sum256(cert.RawTBSCertificate)
+				for _, hash := range certHashes {
+					if bytes.Equal(digest[:], hash) {
+						return nil
+					}
+				}
+			}
+			return errors.New("no certificate matches the cert hashes")
+		}
+	}
+	return tlsConfig
+}
+
+// verifiedCertificates returns the certificates in the verified chains, the extra certificates sent by the server but
+// not in any chain are left out, they prove nothing
+func verifiedCertificates(state tls.ConnectionState) []*x509.Certificate {
+	var certs []*x509.Certificate
+	for _, chain := range state.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	return certs
+}
+
+// tlsVersions are the minimum TLS versions in the config file
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// pinUpstreamSPKI adds the SPKI pins to the TLS config, one of the certificates in the chain must have the SHA256
+// digest of its SubjectPublicKeyInfo in them, the other verifications still apply
+func pinUpstreamSPKI(tlsConfig *tls.Config, pins [][]byte) {
+	verify := tlsConfig.VerifyConnection
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		if verify != nil {
+			if err := verify(state); err != nil {
+				return err
+			}
+		}
+		for _, cert := range verifiedCertificates(state) {
+			digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if bytes.Equal(digest[:], pin) {
+					return nil
+				}
+			}
+		}
+		return errors.New("no certificate matches the spki pins")
+	}
+}
+
+// parseSPKIPin decodes a base64 SHA256 SPKI pin, with an optional sha256/ prefix
+func parseSPKIPin(pin string) ([]byte, error) {
+	digest, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+	if err != nil {
+		return nil, err
+	}
+	if len(digest) != sha256.Size {
+		return nil, fmt.Errorf("the spki pin must be a SHA256 digest, got %d bytes", len(digest))
+	}
+	return digest, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadUpstreamTLSConfig(t *testing.T) {
+	ta := assert.New(t)
+
+	// the server requires a client certificate
+	serverCert, _ := testCertificate(t)
+	clientCert, clientPool := testCertificate(t)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientPool,
+	})
+	ta.Nil(err)
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			msg := &dns.Msg{}
+			msg.SetReply(req)
+			w.WriteMsg(msg)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+
+	dir := t.TempDir()
+	writePEM := func(filename, blockType string, der []byte) string {
+		path := filepath.Join(dir, filename)
+		ta.Nil(ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(clientCert.PrivateKey)
+	ta.Nil(err)
+	certFile := writePEM("client.crt", "CERTIFICATE", clientCert.Certificate[0])
+	keyFile := writePEM("client.key", "PRIVATE KEY", keyDER)
+	caFile := writePEM("ca.pem", "CERTIFICATE", serverCert.Certificate[0])
+	spki := sha256.Sum256(serverCert.Leaf.RawSubjectPublicKeyInfo)
+	pin := "sha256/" + base64.StdEncoding.EncodeToString(spki[:])
+
+	query := func(options *UpstreamTLSConfig) error {
+		upstreamConfig := &UpstreamConfig{TLS: options}
+		// the address is an IP, the server name is verified instead
+		client, err := NewDoTClient(listener.Addr().String(), loadUpstreamTLSConfig("dot", upstreamConfig, ""), nil)
+		ta.Nil(err)
+		req := &dns.Msg{}
+		req.SetQuestion("www.example.com.", dns.TypeA)
+		_, err = client.Exchange(req)
+		return err
+	}
+
+	options := &UpstreamTLSConfig{Cert: certFile, Key: keyFile, CA: caFile, Pins: StringList{pin}, MinVersion: "1.3", ServerName: "localhost"}
+	ta.Nil(query(options))
+
+	noClientCert := *options
+	noClientCert.Cert, noClientCert.Key = "", ""
+	ta.NotNil(query(&noClientCert))
+
+	otherPin := *options
+	otherPin.Pins = StringList{base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))}
+	ta.NotNil(query(&otherPin))
+
+	otherName := *options
+	otherName.ServerName = "dns.example.com"
+	ta.NotNil(query(&otherName))
+
+	// the pinned certificate is only sent as an extra one, which isn't in the verified chain
+	address, extraCAFile := testExtraCertificateServer(t, serverCert)
+	client, err := NewDoTClient(address, loadUpstreamTLSConfig("dot", &UpstreamConfig{TLS: &UpstreamTLSConfig{CA: extraCAFile, Pins: StringList{pin}}}, "localhost"), nil)
+	ta.Nil(err)
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = client.Exchange(req)
+	ta.NotNil(err)
+
+	_, err = parseSPKIPin("c2hvcnQ=")
+	ta.NotNil(err)
+}
+
+// testExtraCertificateServer starts a DoT server presenting its own certificate and the extra certificate, and returns
+// its address and the CA file trusting its own certificate
+func testExtraCertificateServer(t *testing.T, extra tls.Certificate) (string, string) {
+	cert, _ := testCertificate(t)
+	cert.Certificate = append(cert.Certificate, extra.Certificate[0])
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{
+		Listener: listener,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			msg := &dns.Msg{}
+			msg.SetReply(req)
+			w.WriteMsg(msg)
+		}),
+	}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return listener.Addr().String(), caFile
+}
+
+func TestNewUpstreamTLSConfig_ExtraCertificate(t *testing.T) {
+	ta := assert.New(t)
+
+	// the hashed certificate is only sent as an extra one, which isn't in the verified chain
+	pinned, _ := testCertificate(t)
+	address, caFile := testExtraCertificateServer(t, pinned)
+	hash := sha256.Sum256(pinned.Leaf.RawTBSCertificate)
+
+	tlsConfig := newUpstreamTLSConfig("localhost", [][]byte{hash[:]})
+	tlsConfig.RootCAs = loadUpstreamTLSConfig("dot", &UpstreamConfig{TLS: &UpstreamTLSConfig{CA: caFile}}, "localhost").RootCAs
+	client, err := NewDoTClient(address, tlsConfig, nil)
+	ta.Nil(err)
+	req := &dns.Msg{}
+	req.SetQuestion("www.example.com.", dns.TypeA)
+	_, err = client.Exchange(req)
+	ta.NotNil(err)
+}
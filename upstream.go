@@ -2,14 +2,16 @@ package main
 
 import (
 	"bytes"
-	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"github.com/miekg/dns"
 	"go.uber.org/zap"
-	"golang.org/x/net/http2"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
@@ -44,7 +46,11 @@ type UpstreamDNS struct {
 // UpstreamDoh is an abstract DNS-over-HTTPS upstream
 type UpstreamDoh struct {
 	UpstreamImpl
-	proxy *url.URL
+	url *url.URL
+	// template is the URI template of the address, empty if the address is not a template
+	template string
+	header   http.Header
+	client   *http.Client
 }
 
 // UpstreamDohGet is the DNS-over-HTTPS upstream implement using HTTP GET method
@@ -57,11 +63,58 @@ type UpstreamDohPost struct {
 	UpstreamDoh
 }
 
+// UpstreamDohJSON is the DNS-over-HTTPS upstream implement using the JSON API of Google and Cloudflare
+type UpstreamDohJSON struct {
+	UpstreamDoh
+}
+
+// UpstreamDoQ is the DNS-over-QUIC upstream
+type UpstreamDoQ struct {
+	UpstreamImpl
+	client *DoQClient
+}
+
+// UpstreamDoT is the DNS-over-TLS upstream
+type UpstreamDoT struct {
+	UpstreamImpl
+	client *DoTClient
+}
+
+// UpstreamODoH is the Oblivious DNS over HTTPS upstream
+type UpstreamODoH struct {
+	UpstreamImpl
+	client *ODoHClient
+}
+
+// UpstreamDNSCrypt is the DNSCrypt v2 upstream
+type UpstreamDNSCrypt struct {
+	UpstreamImpl
+	client *DNSCryptClient
+}
+
+// UpstreamZone answers authoritatively from a local zone file
+type UpstreamZone struct {
+	UpstreamImpl
+	zone *Zone
+}
+
+// UpstreamHosts answers from hosts format files
+type UpstreamHosts struct {
+	UpstreamImpl
+	hosts    *Hosts
+	interval time.Duration
+}
+
 // UpstreamBlackHole does nothing to all DNS requests
-type UpstreamBlackHole struct{}
+type UpstreamBlackHole struct {
+	UpstreamImpl
+}
 
-// UpstreamReject returns error the all DNS requests
-type UpstreamReject struct{}
+// UpstreamReject answers all DNS requests with the block response
+type UpstreamReject struct {
+	UpstreamImpl
+	block *BlockResponse
+}
 
 // Type returns the type of the dns upstream
 func (upstream *UpstreamDNS) Type() string {
@@ -78,6 +131,41 @@ func (upstream *UpstreamDohPost) Type() string {
 	return "doh-post"
 }
 
+// Type returns the type of the DNS-over-HTTPS upstream using the JSON API
+func (upstream *UpstreamDohJSON) Type() string {
+	return "doh-json"
+}
+
+// Type returns the type of the DNS-over-QUIC upstream
+func (upstream *UpstreamDoQ) Type() string {
+	return "doq"
+}
+
+// Type returns the type of the DNS-over-TLS upstream
+func (upstream *UpstreamDoT) Type() string {
+	return "dot"
+}
+
+// Type returns the type of the Oblivious DNS over HTTPS upstream
+func (upstream *UpstreamODoH) Type() string {
+	return "odoh"
+}
+
+// Type returns the type of the DNSCrypt upstream
+func (upstream *UpstreamDNSCrypt) Type() string {
+	return "dnscrypt"
+}
+
+// Type returns the type of the zone upstream
+func (upstream *UpstreamZone) Type() string {
+	return "zone"
+}
+
+// Type returns the type of the hosts upstream
+func (upstream *UpstreamHosts) Type() string {
+	return "hosts"
+}
+
 // Type returns the type of the black hole upstream
 func (upstream *UpstreamBlackHole) Type() string {
 	return "blackhole"
@@ -88,40 +176,35 @@ func (upstream *UpstreamReject) Type() string {
 	return "reject"
 }
 
-// Name returns the black hole upstream name
-func (upstream *UpstreamBlackHole) Name() string {
-	return "blackhole"
-}
-
-// Name returns the reject upstream name
-func (upstream *UpstreamReject) Name() string {
-	return "reject"
+// getURL returns the URL of a GET request with the dns parameter, the query string of the URL is kept
+func (upstream *UpstreamDoh) getURL(dnsParam string) string {
+	if upstream.template != "" {
+		return dohTemplatePattern.ReplaceAllStringFunc(upstream.template, func(expression string) string {
+			// {?dns} or {&dns}
+			return expression[1:2] + "dns=" + dnsParam
+		})
+	}
+	u := *upstream.url
+	query := u.Query()
+	query.Set("dns", dnsParam)
+	u.RawQuery = query.Encode()
+	return u.String()
 }
 
-func (upstream *UpstreamDoh) dohQuery(w dns.ResponseWriter, req *dns.Msg, method string) {
-	logger := zap.L().Named("answer").With(zap.Uint16("id", req.Id))
-
-	u, err := url.Parse(upstream.address)
+// newRequest creates a request with the configured headers
+func (upstream *UpstreamDoh) newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	httpReq, err := http.NewRequest(method, url, body)
 	if err != nil {
-		logger.Fatal("doh url parse error", zap.Error(err))
-	}
-
-	// Update TLS and HTTP client configuration
-	tlsConfig := &tls.Config{ServerName: u.Hostname()}
-	transport := &http.Transport{
-		TLSClientConfig:    tlsConfig,
-		DisableCompression: true,
-		MaxIdleConns:       1,
+		return nil, err
 	}
-	if upstream.proxy != nil {
-		transport.Proxy = http.ProxyURL(upstream.proxy)
+	for name, values := range upstream.header {
+		httpReq.Header[name] = values
 	}
-	http2.ConfigureTransport(transport)
+	return httpReq, nil
+}
 
-	client := &http.Client{
-		Timeout:   5 * time.Second,
-		Transport: transport,
-	}
+func (upstream *UpstreamDoh) dohQuery(w dns.ResponseWriter, req *dns.Msg, method string) {
+	logger := zap.L().Named("answer").With(zap.Uint16("id", req.Id))
 
 	// start
 	msg, err := req.Pack()
@@ -134,9 +217,12 @@ func (upstream *UpstreamDoh) dohQuery(w dns.ResponseWriter, req *dns.Msg, method
 	switch method {
 	case "GET":
 		base64str := base64.RawURLEncoding.EncodeToString(msg)
-		httpReq, err = http.NewRequest("GET", u.String()+"?dns="+base64str, bytes.NewBuffer(msg))
+		httpReq, err = upstream.newRequest("GET", upstream.getURL(base64str), nil)
 	case "POST":
-		httpReq, err = http.NewRequest("POST", u.String(), bytes.NewBuffer(msg))
+		httpReq, err = upstream.newRequest("POST", upstream.url.String(), bytes.NewReader(msg))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", dohContentType)
+		}
 	default:
 		zap.L().Fatal("illegal http method", zap.String("method", method))
 	}
@@ -145,11 +231,8 @@ func (upstream *UpstreamDoh) dohQuery(w dns.ResponseWriter, req *dns.Msg, method
 		logger.Error("doh req err", zap.Error(err))
 		return
 	}
-	httpReq.Header.Add("Content-Type", "application/dns-message")
-	httpReq.Header.Set("Connection", "close")
-	httpReq.Host = u.Hostname()
 
-	httpResp, err := client.Do(httpReq)
+	httpResp, err := upstream.client.Do(httpReq)
 	if err != nil {
 		logger.Warn("doh resp err", zap.Error(err))
 		return
@@ -165,13 +248,6 @@ func (upstream *UpstreamDoh) dohQuery(w dns.ResponseWriter, req *dns.Msg, method
 			return
 		}
 		w.Write(buf)
-
-		// set cache
-		replMsg := &dns.Msg{}
-		err = replMsg.Unpack(buf)
-		if err == nil {
-			SetCache(req.Question[0].String(), replMsg)
-		}
 	case http.StatusBadRequest: // 400
 		logger.Info("DNS query not specified or too small.")
 	case http.StatusRequestEntityTooLarge: // 413
@@ -196,9 +272,6 @@ func (upstream *UpstreamDNS) Query(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 	w.WriteMsg(r)
-
-	// set cache
-	SetCache(req.Question[0].String(), r)
 }
 
 // Query does the exact query action of an DNS-over-HTTPS upstream using HTTP GET method
@@ -211,6 +284,93 @@ func (upstream *UpstreamDohPost) Query(w dns.ResponseWriter, req *dns.Msg) {
 	upstream.dohQuery(w, req, "POST")
 }
 
+// Query does the exact query action of an DNS-over-HTTPS upstream using the JSON API
+func (upstream *UpstreamDohJSON) Query(w dns.ResponseWriter, req *dns.Msg) {
+	logger := zap.L().Named("answer").With(zap.Uint16("id", req.Id))
+	if len(req.Question) == 0 {
+		return
+	}
+
+	httpReq, err := upstream.newRequest("GET", dohJSONURL(upstream.url, req), nil)
+	if err != nil {
+		logger.Error("doh json req err", zap.Error(err))
+		return
+	}
+
+	httpResp, err := upstream.client.Do(httpReq)
+	if err != nil {
+		logger.Warn("doh json resp err", zap.Error(err))
+		return
+	}
+	defer httpResp.Body.Close()
+
+	if httpResp.StatusCode != http.StatusOK {
+		logger.Info("Unknown http status code", zap.Int("code", httpResp.StatusCode))
+		return
+	}
+	buf, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		logger.Error("doh json read http body error", zap.Error(err))
+		return
+	}
+	msg, err := dohJSONToMsg(req, buf)
+	if err != nil {
+		logger.Warn("doh json answer parse error", zap.Error(err))
+		return
+	}
+	w.WriteMsg(msg)
+}
+
+// Query does the exact query action of a DNS-over-QUIC upstream
+func (upstream *UpstreamDoQ) Query(w dns.ResponseWriter, req *dns.Msg) {
+	msg, err := upstream.client.Exchange(req)
+	if err != nil {
+		zap.L().Named("answer").Warn("exchange doq server failed", zap.Uint16("id", req.Id), zap.Error(err))
+		return
+	}
+	w.WriteMsg(msg)
+}
+
+// Query does the exact query action of a DNS-over-TLS upstream
+func (upstream *UpstreamDoT) Query(w dns.ResponseWriter, req *dns.Msg) {
+	msg, err := upstream.client.Exchange(req)
+	if err != nil {
+		zap.L().Named("answer").Warn("exchange dot server failed", zap.Uint16("id", req.Id), zap.Error(err))
+		return
+	}
+	w.WriteMsg(msg)
+}
+
+// Query does the exact query action of an Oblivious DNS over HTTPS upstream
+func (upstream *UpstreamODoH) Query(w dns.ResponseWriter, req *dns.Msg) {
+	msg, err := upstream.client.Exchange(req)
+	if err != nil {
+		zap.L().Named("answer").Warn("exchange odoh server failed", zap.Uint16("id", req.Id), zap.Error(err))
+		return
+	}
+	w.WriteMsg(msg)
+}
+
+// Query does the exact query action of a DNSCrypt upstream
+func (upstream *UpstreamDNSCrypt) Query(w dns.ResponseWriter, req *dns.Msg) {
+	msg, err := upstream.client.Exchange(req)
+	if err != nil {
+		zap.L().Named("answer").Warn("exchange dnscrypt server failed", zap.Uint16("id", req.Id), zap.Error(err))
+		return
+	}
+	w.WriteMsg(msg)
+}
+
+// Query does the exact query action of a zone upstream
+func (upstream *UpstreamZone) Query(w dns.ResponseWriter, req *dns.Msg) {
+	w.WriteMsg(upstream.zone.Lookup(req))
+}
+
+// Query does the exact query action of a hosts upstream
+func (upstream *UpstreamHosts) Query(w dns.ResponseWriter, req *dns.Msg) {
+	w.WriteMsg(upstream.hosts.Lookup(req))
+}
+
 // Query does the exact query action of an black hole upstream
 func (upstream *UpstreamBlackHole) Query(w dns.ResponseWriter, req *dns.Msg) {
 	// just do nothing
@@ -218,7 +378,18 @@ func (upstream *UpstreamBlackHole) Query(w dns.ResponseWriter, req *dns.Msg) {
 
 // Query does the exact query action of an reject upstream
 func (upstream *UpstreamReject) Query(w dns.ResponseWriter, req *dns.Msg) {
-	msg := &dns.Msg{}
-	msg.SetReply(req)
-	w.WriteMsg(msg)
+	w.WriteMsg(upstream.block.Reply(req))
+}
+
+// splitUpstreamAddress returns the host and the port of an address with an optional scheme prefix and port
+func splitUpstreamAddress(address, prefix, defaultPort string) (host, port string, err error) {
+	address = strings.TrimPrefix(address, prefix)
+	host, port, err = net.SplitHostPort(address)
+	if err != nil {
+		host, port = strings.Trim(address, "[]"), defaultPort
+	}
+	if host == "" {
+		return "", "", errors.New("upstream address requires a host")
+	}
+	return host, port, nil
 }
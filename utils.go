@@ -19,3 +19,34 @@ func fillRightDot(s string) string {
 func fillBothDots(s string) string {
 	return fillRightDot(fillLeftDot(s))
 }
+
+// splitOutsideQuotes splits s around the separators which are not quoted by double quotes, the quotes are kept
+func splitOutsideQuotes(s string, isSep func(rune) bool) []string {
+	var parts []string
+	var current strings.Builder
+	quoted, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+			current.WriteRune(r)
+		case quoted && r == '\\':
+			escaped = true
+			current.WriteRune(r)
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case !quoted && isSep(r):
+			if current.Len() > 0 {
+				parts = append(parts, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		parts = append(parts, current.String())
+	}
+	return parts
+}
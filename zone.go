@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/miekg/dns"
+	"io"
+	"os"
+	"strings"
+)
+
+// maxZoneCNAMEChain limits the CNAME records chased inside a zone
+const maxZoneCNAMEChain = 8
+
+// Zone is an authoritative zone loaded from an RFC 1035 master file
+type Zone struct {
+	origin  string
+	soa     *dns.SOA
+	records map[string][]dns.RR
+	// names holds all the owner names and the empty non-terminals between them and the origin
+	names map[string]bool
+}
+
+// LoadZoneFile loads a zone from the master file, the origin could be empty if the file sets $ORIGIN
+func LoadZoneFile(filename, origin string) (*Zone, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadZone(f, origin, filename)
+}
+
+// LoadZone loads a zone in master file format from the reader
+func LoadZone(r io.Reader, origin, filename string) (*Zone, error) {
+	if origin != "" {
+		origin = strings.ToLower(dns.Fqdn(origin))
+	}
+
+	var rrs []dns.RR
+	zp := dns.NewZoneParser(r, origin, filename)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	zone := &Zone{
+		origin:  origin,
+		records: map[string][]dns.RR{},
+		names:   map[string]bool{},
+	}
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			if zone.soa != nil {
+				return nil, errors.New("more than one SOA record")
+			}
+			zone.soa = soa
+			if zone.origin == "" {
+				zone.origin = strings.ToLower(soa.Hdr.Name)
+			}
+		}
+	}
+	if zone.soa == nil {
+		return nil, errors.New("SOA record not found")
+	}
+	if !strings.EqualFold(zone.soa.Hdr.Name, zone.origin) {
+		return nil, fmt.Errorf("SOA record %s is not at the zone origin %s", zone.soa.Hdr.Name, zone.origin)
+	}
+
+	for _, rr := range rrs {
+		name := strings.ToLower(rr.Header().Name)
+		if !dns.IsSubDomain(zone.origin, name) {
+			return nil, fmt.Errorf("record %s is out of zone %s", rr.Header().Name, zone.origin)
+		}
+		zone.records[name] = append(zone.records[name], rr)
+		for ; name != zone.origin; name = parentName(name) {
+			zone.names[name] = true
+		}
+	}
+	zone.names[zone.origin] = true
+
+	return zone, nil
+}
+
+// Origin returns the zone origin
+func (zone *Zone) Origin() string {
+	return zone.origin
+}
+
+// Lookup answers the request authoritatively
+func (zone *Zone) Lookup(req *dns.Msg) *dns.Msg {
+	msg := &dns.Msg{}
+	msg.SetReply(req)
+
+	question := req.Question[0]
+	qname := strings.ToLower(question.Name)
+	if !dns.IsSubDomain(zone.origin, qname) {
+		msg.Rcode = dns.RcodeRefused
+		return msg
+	}
+	msg.Authoritative = true
+
+	for i := 0; i <= maxZoneCNAMEChain; i++ {
+		// delegation
+		if cut := zone.findCut(qname, question.Qtype); cut != "" {
+			msg.Authoritative = len(msg.Answer) > 0
+			zone.refer(msg, cut)
+			return msg
+		}
+
+		rrs, found := zone.records[qname]
+		if !found && !zone.names[qname] {
+			// wildcard
+			if rrs, found = zone.findWildcard(qname); !found {
+				// the rcode is of the last name in the chain, RFC 6604
+				msg.Rcode = dns.RcodeNameError
+				zone.addNegativeSOA(msg)
+				return msg
+			}
+		}
+
+		// cname
+		if question.Qtype != dns.TypeCNAME {
+			if cname := findRRType(rrs, dns.TypeCNAME); len(cname) > 0 {
+				msg.Answer = append(msg.Answer, withOwner(cname, question.Name)...)
+				target := strings.ToLower(cname[0].(*dns.CNAME).Target)
+				if !dns.IsSubDomain(zone.origin, target) {
+					return msg
+				}
+				qname = target
+				question.Name = cname[0].(*dns.CNAME).Target
+				continue
+			}
+		}
+
+		var answer []dns.RR
+		if question.Qtype == dns.TypeANY {
+			answer = rrs
+		} else {
+			answer = findRRType(rrs, question.Qtype)
+		}
+		if len(answer) == 0 {
+			zone.addNegativeSOA(msg)
+			return msg
+		}
+		msg.Answer = append(msg.Answer, withOwner(answer, question.Name)...)
+		return msg
+	}
+
+	return msg
+}
+
+// findCut returns the delegation point at or above the name, or an empty string if the name isn't delegated
+func (zone *Zone) findCut(qname string, qtype uint16) string {
+	var cut string
+	for name := qname; name != zone.origin; name = parentName(name) {
+		// the DS records are served by the parent side of the cut
+		if name == qname && qtype == dns.TypeDS {
+			continue
+		}
+		if len(findRRType(zone.records[name], dns.TypeNS)) > 0 {
+			cut = name
+		}
+	}
+	return cut
+}
+
+// refer fills the referral to the delegation point into the message
+func (zone *Zone) refer(msg *dns.Msg, cut string) {
+	ns := findRRType(zone.records[cut], dns.TypeNS)
+	msg.Ns = append(msg.Ns, ns...)
+	for _, rr := range ns {
+		target := strings.ToLower(rr.(*dns.NS).Ns)
+		if !dns.IsSubDomain(zone.origin, target) {
+			continue
+		}
+		msg.Extra = append(msg.Extra, findRRType(zone.records[target], dns.TypeA)...)
+		msg.Extra = append(msg.Extra, findRRType(zone.records[target], dns.TypeAAAA)...)
+	}
+}
+
+// findWildcard returns the records of the wildcard at the closest encloser of the name
+func (zone *Zone) findWildcard(qname string) ([]dns.RR, bool) {
+	for name := parentName(qname); dns.IsSubDomain(zone.origin, name); name = parentName(name) {
+		if zone.names[name] {
+			rrs, found := zone.records["*."+name]
+			return rrs, found
+		}
+		if name == zone.origin {
+			break
+		}
+	}
+	return nil, false
+}
+
+// addNegativeSOA adds the SOA record to the authority section of the NXDOMAIN and NODATA answers
+func (zone *Zone) addNegativeSOA(msg *dns.Msg) {
+	soa := dns.Copy(zone.soa).(*dns.SOA)
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+	msg.Ns = append(msg.Ns, soa)
+}
+
+func findRRType(rrs []dns.RR, rrtype uint16) []dns.RR {
+	var result []dns.RR
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			result = append(result, rr)
+		}
+	}
+	return result
+}
+
+// withOwner copies the records with the owner name, it makes the wildcard records look like the query name
+func withOwner(rrs []dns.RR, name string) []dns.RR {
+	result := make([]dns.RR, 0, len(rrs))
+	for _, rr := range rrs {
+		rr = dns.Copy(rr)
+		rr.Header().Name = name
+		result = append(result, rr)
+	}
+	return result
+}
+
+// parentName returns the name without the leftmost label, the parent of the root is the root
+func parentName(name string) string {
+	if i, end := dns.NextLabel(name, 0); !end {
+		return name[i:]
+	}
+	return "."
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+)
+
+const testZone = `$ORIGIN home.lan.
+$TTL 3600
+@        IN SOA   ns.home.lan. admin.home.lan. 1 7200 3600 1209600 300
+@        IN NS    ns.home.lan.
+ns       IN A     192.168.1.1
+nas      IN A     192.168.1.10
+nas      IN AAAA  fd00::10
+files    IN CNAME nas
+ext      IN CNAME www.google.com.
+gone     IN CNAME missing
+*.dev    IN A     192.168.1.20
+a.b.c    IN TXT   "deep"
+lab      IN NS    ns.lab.home.lan.
+ns.lab   IN A     192.168.2.1
+`
+
+func lookupTestZone(t *testing.T, name string, qtype uint16) *dns.Msg {
+	zone, err := LoadZone(strings.NewReader(testZone), "", "test.zone")
+	assert.Nil(t, err)
+	req := &dns.Msg{}
+	req.SetQuestion(name, qtype)
+	return zone.Lookup(req)
+}
+
+func TestZone_Lookup(t *testing.T) {
+	ta := assert.New(t)
+
+	msg := lookupTestZone(t, "NAS.home.lan.", dns.TypeA)
+	ta.True(msg.Authoritative)
+	ta.Equal(dns.RcodeSuccess, msg.Rcode)
+	ta.Len(msg.Answer, 1)
+
+	// NODATA
+	msg = lookupTestZone(t, "ns.home.lan.", dns.TypeAAAA)
+	ta.Equal(dns.RcodeSuccess, msg.Rcode)
+	ta.Len(msg.Answer, 0)
+	ta.Equal(dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+	ta.Equal(uint32(300), msg.Ns[0].Header().Ttl)
+
+	// empty non-terminal
+	msg = lookupTestZone(t, "b.c.home.lan.", dns.TypeA)
+	ta.Equal(dns.RcodeSuccess, msg.Rcode)
+	ta.Len(msg.Answer, 0)
+
+	// NXDOMAIN
+	msg = lookupTestZone(t, "nothing.home.lan.", dns.TypeA)
+	ta.Equal(dns.RcodeNameError, msg.Rcode)
+	ta.Equal(dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+
+	// out of zone
+	msg = lookupTestZone(t, "www.google.com.", dns.TypeA)
+	ta.Equal(dns.RcodeRefused, msg.Rcode)
+}
+
+func TestZone_LookupCNAME(t *testing.T) {
+	ta := assert.New(t)
+
+	msg := lookupTestZone(t, "files.home.lan.", dns.TypeAAAA)
+	ta.Len(msg.Answer, 2)
+	ta.Equal(dns.TypeCNAME, msg.Answer[0].Header().Rrtype)
+	ta.Equal("nas.home.lan.", msg.Answer[1].Header().Name)
+
+	msg = lookupTestZone(t, "files.home.lan.", dns.TypeCNAME)
+	ta.Len(msg.Answer, 1)
+
+	// out of zone target is left to the client
+	msg = lookupTestZone(t, "ext.home.lan.", dns.TypeA)
+	ta.Equal(dns.RcodeSuccess, msg.Rcode)
+	ta.Len(msg.Answer, 1)
+
+	// the in zone target doesn't exist
+	msg = lookupTestZone(t, "gone.home.lan.", dns.TypeA)
+	ta.Equal(dns.RcodeNameError, msg.Rcode)
+	ta.Len(msg.Answer, 1)
+	ta.Equal(dns.TypeSOA, msg.Ns[0].Header().Rrtype)
+}
+
+func TestZone_LookupWildcard(t *testing.T) {
+	ta := assert.New(t)
+
+	msg := lookupTestZone(t, "app.dev.home.lan.", dns.TypeA)
+	ta.Len(msg.Answer, 1)
+	ta.Equal("app.dev.home.lan.", msg.Answer[0].Header().Name)
+
+	msg = lookupTestZone(t, "x.app.dev.home.lan.", dns.TypeA)
+	ta.Len(msg.Answer, 1)
+
+	// the closest encloser nas.home.lan has no wildcard
+	msg = lookupTestZone(t, "x.nas.home.lan.", dns.TypeA)
+	ta.Equal(dns.RcodeNameError, msg.Rcode)
+}
+
+func TestZone_LookupDelegation(t *testing.T) {
+	ta := assert.New(t)
+
+	msg := lookupTestZone(t, "pc.lab.home.lan.", dns.TypeA)
+	ta.False(msg.Authoritative)
+	ta.Len(msg.Answer, 0)
+	ta.Equal(dns.TypeNS, msg.Ns[0].Header().Rrtype)
+	ta.Len(msg.Extra, 1)
+
+	// the zone apex is never a referral
+	msg = lookupTestZone(t, "home.lan.", dns.TypeNS)
+	ta.True(msg.Authoritative)
+	ta.Len(msg.Answer, 1)
+}